@@ -7,3 +7,8 @@ import "github.com/NickBlow/gqlssehandlers/subscriptions"
 // detailing whether more events of this type should be expected
 // It will return an error if something went wrong when executing the callback
 type NewEventCallback func(subscriptions.WrappedEvent) error
+
+// RawEventCallback is a function that should be called once for every domain event, rather than once for each
+// interested subscription. The library decides which subscriptions the event applies to, and executes their queries.
+// It will return an error if something went wrong when executing the callback
+type RawEventCallback func(subscriptions.RawEvent) error
@@ -2,10 +2,7 @@ package clientid
 
 import (
 	"context"
-	"fmt"
 	"net/http"
-
-	gonanoid "github.com/matoous/go-nanoid"
 )
 
 type contextKeyType string
@@ -30,8 +27,8 @@ const ClientIDHeader = "X-Gql-Sse-Client-Id"
 
 // DefaultCookieName is the name of the cookie that will contain the client ID. The ClientIDHeader and ClientIDQueryString will take priority over the cookie.
 // By default, this cookie is set when it does not exist.
-// As the server cannot handle multiple connected clients with the same id (it will replace the latest one),
-// this is not safe to use across multiple browser tabs if they all need to be connected.
+// It is shared by every browser tab, so all their streams have the same client ID, which the server's
+// connection policy decides how to handle.
 const DefaultCookieName = "gql_sse_client_id"
 
 // SetClientIDOnRequest sets the ClientID on the request context in a typesafe way
@@ -52,46 +49,13 @@ func GetClientIDFromRequest(r *http.Request) string {
 }
 
 func getClientIDFromDefaults(r *http.Request) string {
-	if qs := r.URL.Query().Get(ClientIDQueryString); qs != "" {
-		return qs
-	}
-	if headerArray, ok := r.Header[ClientIDHeader]; ok && len(headerArray) > 1 {
-		return headerArray[0]
-	}
-	cookie, err := r.Cookie(DefaultCookieName)
-	if err != nil {
-		return ""
-	}
-	return cookie.Value
-}
-
-func setDefaultCookie(w http.ResponseWriter) (string, error) {
-	newClientID, err := gonanoid.Nanoid()
-	if err != nil {
-		return "", err
-	}
-	http.SetCookie(w, &http.Cookie{
-		Name:  DefaultCookieName,
-		Value: newClientID,
-	})
-	return newClientID, nil
+	clientID, _ := (&CookieProvider{}).Resolve(r)
+	return clientID
 }
 
 // Middleware adds the clientID to the request, either by using the existing value in the context
-// or by using a cookie fallback
+// or by using a cookie fallback, as a CookieProvider with the default attributes does.
+// The IDs aren't checked, use a Signer to stop clients using each other's IDs
 func Middleware(next http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		clientID := GetClientIDFromRequest(r)
-		var err error
-		if clientID == "" {
-			clientID, err = setDefaultCookie(w)
-			if err != nil {
-				fmt.Println("Couldn't generate client ID")
-				http.Error(w, "Error", http.StatusInternalServerError)
-				return
-			}
-		}
-		newRequest := SetClientIDOnRequest(r, clientID)
-		next.ServeHTTP(w, newRequest)
-	}
+	return ProviderMiddleware(&CookieProvider{}, nil)(next)
 }
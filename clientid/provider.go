@@ -0,0 +1,195 @@
+package clientid
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/graphql-go/graphql/gqlerrors"
+	gonanoid "github.com/matoous/go-nanoid"
+)
+
+// Provider finds the client ID of a request, and issues new client IDs.
+// Resolve returns an empty string if the request has no client ID, or an error if it has one that isn't acceptable,
+// in which case the request is rejected with a 401.
+// Issue creates a client ID for a request without one, and sets whatever headers the client needs to send it back.
+type Provider interface {
+	Resolve(r *http.Request) (string, error)
+	Issue(r *http.Request, header http.Header) (string, error)
+}
+
+// InitOnlyProvider can optionally be implemented by a Provider. If IssuesOnlyOnInit returns true,
+// client IDs are only issued in answer to a GQL_INIT message, and other requests must already have one.
+type InitOnlyProvider interface {
+	IssuesOnlyOnInit() bool
+}
+
+// IssuesOnlyOnInit reports whether the provider only issues client IDs in answer to a GQL_INIT message
+func IssuesOnlyOnInit(provider Provider) bool {
+	initOnly, ok := provider.(InitOnlyProvider)
+	return ok && initOnly.IssuesOnlyOnInit()
+}
+
+// deliverer is implemented by the built in providers, which can send the client any ID, not just one they generated.
+// Signer uses it to send signed IDs
+type deliverer interface {
+	deliver(r *http.Request, header http.Header, clientID string)
+}
+
+// CanDeliver reports whether the provider is one a Signer can send signed IDs with, which only the built in ones are
+func CanDeliver(p Provider) bool {
+	_, ok := p.(deliverer)
+	return ok
+}
+
+func issueWith(d deliverer, r *http.Request, header http.Header) (string, error) {
+	clientID, err := gonanoid.Nanoid()
+	if err != nil {
+		return "", err
+	}
+	d.deliver(r, header, clientID)
+	return clientID, nil
+}
+
+// CookieProvider is the default Provider. It reads the client ID from the ClientIDQueryString, ClientIDHeader
+// or a cookie, in that order, and issues new IDs in a cookie to any request without one.
+// Name defaults to DefaultCookieName, and the other fields are the attributes of the cookie.
+type CookieProvider struct {
+	Name     string
+	Path     string
+	Domain   string
+	MaxAge   int
+	Secure   bool
+	HttpOnly bool
+	SameSite http.SameSite
+}
+
+func (c *CookieProvider) cookieName() string {
+	if c.Name == "" {
+		return DefaultCookieName
+	}
+	return c.Name
+}
+
+// Resolve returns the client ID from the query string, header or cookie
+func (c *CookieProvider) Resolve(r *http.Request) (string, error) {
+	if qs := r.URL.Query().Get(ClientIDQueryString); qs != "" {
+		return qs, nil
+	}
+	if header := r.Header.Get(ClientIDHeader); header != "" {
+		return header, nil
+	}
+	cookie, err := r.Cookie(c.cookieName())
+	if err != nil {
+		return "", nil
+	}
+	return cookie.Value, nil
+}
+
+// Issue generates a client ID and sets it as a cookie
+func (c *CookieProvider) Issue(r *http.Request, header http.Header) (string, error) {
+	return issueWith(c, r, header)
+}
+
+func (c *CookieProvider) deliver(r *http.Request, header http.Header, clientID string) {
+	cookie := &http.Cookie{
+		Name:     c.cookieName(),
+		Value:    clientID,
+		Path:     c.Path,
+		Domain:   c.Domain,
+		MaxAge:   c.MaxAge,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+		SameSite: c.SameSite,
+	}
+	header.Add("Set-Cookie", cookie.String())
+}
+
+// HeaderProvider only reads the client ID from the ClientIDHeader, and issues new IDs in the same header of the response.
+// As EventSource can't set headers, it suits clients using fetch to read the stream.
+type HeaderProvider struct{}
+
+// Resolve returns the client ID from the header
+func (HeaderProvider) Resolve(r *http.Request) (string, error) {
+	return r.Header.Get(ClientIDHeader), nil
+}
+
+// Issue generates a client ID and sets it in the response header
+func (h HeaderProvider) Issue(r *http.Request, header http.Header) (string, error) {
+	return issueWith(h, r, header)
+}
+
+func (HeaderProvider) deliver(r *http.Request, header http.Header, clientID string) {
+	header.Set(ClientIDHeader, clientID)
+}
+
+// PerTabProvider gives each browser tab its own client ID, by only issuing IDs in answer to GQL_INIT and never
+// setting a cookie. The ID is returned in the ClientIDHeader, and each tab should send it back in the header
+// or the ClientIDQueryString, which is the only option for an EventSource.
+type PerTabProvider struct{}
+
+// Resolve returns the client ID from the query string or header
+func (PerTabProvider) Resolve(r *http.Request) (string, error) {
+	if qs := r.URL.Query().Get(ClientIDQueryString); qs != "" {
+		return qs, nil
+	}
+	return r.Header.Get(ClientIDHeader), nil
+}
+
+// Issue generates a client ID and sets it in the response header
+func (p PerTabProvider) Issue(r *http.Request, header http.Header) (string, error) {
+	return issueWith(p, r, header)
+}
+
+func (PerTabProvider) deliver(r *http.Request, header http.Header, clientID string) {
+	header.Set(ClientIDHeader, clientID)
+}
+
+// IssuesOnlyOnInit is always true
+func (PerTabProvider) IssuesOnlyOnInit() bool {
+	return true
+}
+
+// writeResponse writes a response encoded with p, or with the protocol named in the request if p is nil
+func writeResponse(w http.ResponseWriter, r *http.Request, p protocol.Protocol, response func(protocol.Protocol) *protocol.Response) {
+	if p == nil {
+		p = protocol.ProtocolFromRequest(r)
+	}
+	res := response(p)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.StatusCode)
+	w.Write(res.Message)
+}
+
+// ProviderMiddleware returns middleware that adds the client ID from the provider to the request, issuing one if the
+// request doesn't have one, unless the provider only issues them on GQL_INIT. Client IDs set on the context by your
+// own middleware are used as they are, and requests whose client ID the provider rejects are answered with a 401.
+// Errors are answered with a GQL_ERROR encoded with p, or with the protocol named in the request if p is nil.
+func ProviderMiddleware(provider Provider, p protocol.Protocol) func(http.Handler) http.HandlerFunc {
+	return func(next http.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if clientID, ok := r.Context().Value(clientIDKey).(string); ok && clientID != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			clientID, err := provider.Resolve(r)
+			if err != nil {
+				writeResponse(w, r, p, func(p protocol.Protocol) *protocol.Response {
+					return protocol.ErrorResponse(p, http.StatusUnauthorized, gqlerrors.NewFormattedError(err.Error()))
+				})
+				return
+			}
+			if clientID == "" && !IssuesOnlyOnInit(provider) {
+				clientID, err = provider.Issue(r, w.Header())
+				if err != nil {
+					fmt.Println(err)
+					fmt.Println("Couldn't generate client ID")
+					writeResponse(w, r, p, protocol.ServerErrorResponseFor)
+					return
+				}
+			}
+			// set even when empty, so GetClientIDFromRequest doesn't fall back to the defaults
+			next.ServeHTTP(w, SetClientIDOnRequest(r, clientID))
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package clientid
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	gonanoid "github.com/matoous/go-nanoid"
+)
+
+// ErrInvalidSignature is returned when a client ID isn't signed, or wasn't signed by any of the keys for the user
+var ErrInvalidSignature = errors.New("client ID signature is invalid")
+
+// ErrUnsupportedProvider is returned when a Signer wraps a Provider it can't send signed IDs with
+var ErrUnsupportedProvider = errors.New("client IDs can only be signed for the built in providers")
+
+// ErrNoKeys is returned when a Signer has no Keys to sign or verify client IDs with
+var ErrNoKeys = errors.New("client ID signer has no keys")
+
+// Signer signs client IDs with HMAC-SHA256, so they can't be made up or tampered with.
+// New IDs are signed with the first of the Keys, and IDs signed with any of them are accepted,
+// so keys can be rotated by adding the new key at the front and removing the old one once its IDs have expired.
+// If UserFromContext is set, each ID is bound to the user it returns, and is rejected when used by anyone else.
+// Signed IDs are used as the client ID as they are, the signature included.
+// Signer is a Provider, reading and sending IDs with the Provider it wraps, which defaults to a CookieProvider.
+// Only the built in providers can be wrapped.
+type Signer struct {
+	Keys            [][]byte
+	UserFromContext func(ctx context.Context) string
+	Provider        Provider
+}
+
+func (s *Signer) mac(key []byte, id string, user string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	mac.Write([]byte{0})
+	mac.Write([]byte(user))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Signer) user(r *http.Request) string {
+	if s.UserFromContext == nil {
+		return ""
+	}
+	return s.UserFromContext(r.Context())
+}
+
+// Sign returns the id signed for the user, as id.signature. It panics if there are no Keys
+func (s *Signer) Sign(id string, user string) string {
+	return id + "." + s.mac(s.Keys[0], id, user)
+}
+
+// Verify checks that the signed ID was signed for the user by one of the keys
+func (s *Signer) Verify(signed string, user string) error {
+	if len(s.Keys) == 0 {
+		return ErrNoKeys
+	}
+	separator := strings.LastIndex(signed, ".")
+	if separator < 0 {
+		return ErrInvalidSignature
+	}
+	id, signature := signed[:separator], signed[separator+1:]
+	for _, key := range s.Keys {
+		if hmac.Equal([]byte(signature), []byte(s.mac(key, id, user))) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func (s *Signer) provider() Provider {
+	if s.Provider == nil {
+		return &CookieProvider{}
+	}
+	return s.Provider
+}
+
+// Resolve returns the client ID from the wrapped Provider, or an error if it isn't signed for the current user
+func (s *Signer) Resolve(r *http.Request) (string, error) {
+	clientID, err := s.provider().Resolve(r)
+	if err != nil || clientID == "" {
+		return clientID, err
+	}
+	if err := s.Verify(clientID, s.user(r)); err != nil {
+		return "", err
+	}
+	return clientID, nil
+}
+
+// Issue generates a client ID signed for the current user, and sends it with the wrapped Provider
+func (s *Signer) Issue(r *http.Request, header http.Header) (string, error) {
+	if len(s.Keys) == 0 {
+		return "", ErrNoKeys
+	}
+	d, ok := s.provider().(deliverer)
+	if !ok {
+		return "", ErrUnsupportedProvider
+	}
+	clientID, err := gonanoid.Nanoid()
+	if err != nil {
+		return "", err
+	}
+	signed := s.Sign(clientID, s.user(r))
+	d.deliver(r, header, signed)
+	return signed, nil
+}
+
+// IssuesOnlyOnInit is true if it is for the wrapped Provider
+func (s *Signer) IssuesOnlyOnInit() bool {
+	return IssuesOnlyOnInit(s.provider())
+}
+
+// Middleware is like the package Middleware, but the client IDs it issues are signed, and requests sending a client ID
+// that isn't signed for the current user are rejected with a 401. IDs set on the context by your own middleware are trusted.
+func (s *Signer) Middleware(next http.Handler) http.HandlerFunc {
+	return ProviderMiddleware(s, nil)(next)
+}
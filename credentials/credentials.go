@@ -0,0 +1,29 @@
+// Package credentials carries the expiry time of the credentials a request was authenticated with.
+// Set it from your authentication middleware or connect hook, and streams are closed when it passes
+package credentials
+
+import (
+	"context"
+	"time"
+)
+
+type contextKeyType string
+
+const expiryKey contextKeyType = "credentials_expiry"
+
+// WithExpiry returns a copy of the context recording that its credentials expire at the given time
+func WithExpiry(ctx context.Context, expiry time.Time) context.Context {
+	return context.WithValue(ctx, expiryKey, expiry)
+}
+
+// ExpiryFromContext returns the time the context's credentials expire, and false if they don't
+func ExpiryFromContext(ctx context.Context) (time.Time, bool) {
+	expiry, ok := ctx.Value(expiryKey).(time.Time)
+	return expiry, ok
+}
+
+// Expired reports whether the context's credentials have expired by now
+func Expired(ctx context.Context, now time.Time) bool {
+	expiry, ok := ExpiryFromContext(ctx)
+	return ok && !now.Before(expiry)
+}
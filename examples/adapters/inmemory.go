@@ -24,6 +24,7 @@ var subscribersMap = make(map[string]wrappedSubscriptionData)
 // InMemoryAdapter stores subscribers in memory, and triggers events at random intervals
 type InMemoryAdapter struct {
 	resultChannel chan subscriptions.WrappedEvent
+	stopChannel   chan bool
 	mux           sync.Mutex
 }
 
@@ -36,6 +37,7 @@ func (a *InMemoryAdapter) doSubscription(ctx context.Context, data subscriptions
 				Context:        ctx,
 				RequestString:  query.RequestString,
 				VariableValues: query.VariableValues,
+				OperationName:  query.OperationName,
 			})
 			if schema.HasChannelClosedError(res.Errors) {
 				break Loop
@@ -55,9 +57,12 @@ func (a *InMemoryAdapter) doSubscription(ctx context.Context, data subscriptions
 func (a *InMemoryAdapter) StartListening(cb callbacks.NewEventCallback) {
 	exampleNames := []string{"graphql", "gophers", "world"}
 	a.resultChannel = make(chan subscriptions.WrappedEvent)
+	a.stopChannel = make(chan bool)
 	go func() {
 		for {
 			select {
+			case <-a.stopChannel:
+				return
 			case <-time.After(time.Second * time.Duration(rand.Intn(10))):
 				for _, val := range subscribersMap {
 					val.communicationChannel <- schema.SampleEvent{Name: exampleNames[rand.Intn(len(exampleNames))]}
@@ -69,6 +74,12 @@ func (a *InMemoryAdapter) StartListening(cb callbacks.NewEventCallback) {
 	}()
 }
 
+// StopListening stops sending data to subscribers
+func (a *InMemoryAdapter) StopListening() error {
+	close(a.stopChannel)
+	return nil
+}
+
 // cleanUpSubscription removes any existing subscriptions for that clientID/subscriptionID combo
 func (a *InMemoryAdapter) cleanUpSubscription(subscriberData subscriptions.Data) {
 	compoundKey := fmt.Sprintf("%v_%v", subscriberData.ClientID, subscriberData.SubscriptionID)
@@ -0,0 +1,83 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/NickBlow/gqlssehandlers/callbacks"
+	"github.com/NickBlow/gqlssehandlers/examples/schema"
+	"github.com/NickBlow/gqlssehandlers/subscriptions"
+)
+
+// InMemoryPubSubAdapter stores subscribers in memory, and publishes a raw event to the schema.HelloTopic topic
+// at random intervals. The library executes the subscriptions, so it should be used with
+// HandlerConfig.ExecuteSubscriptions and schema.HelloTopicSchema
+type InMemoryPubSubAdapter struct {
+	subscribers map[string]subscriptions.Request
+	stopChannel chan bool
+	mux         sync.Mutex
+}
+
+// StartListening does nothing, as all events are published as raw events.
+func (a *InMemoryPubSubAdapter) StartListening(cb callbacks.NewEventCallback) {}
+
+// StartListeningForRawEvents publishes a SampleEvent at a random interval.
+// It must be called before NotifyNewSubscription or NotifyUnsubscribe as it initialises the subscribers map
+func (a *InMemoryPubSubAdapter) StartListeningForRawEvents(cb callbacks.RawEventCallback) {
+	exampleNames := []string{"graphql", "gophers", "world"}
+	a.subscribers = make(map[string]subscriptions.Request)
+	a.stopChannel = make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-a.stopChannel:
+				return
+			case <-time.After(time.Second * time.Duration(rand.Intn(10))):
+				err := cb(subscriptions.RawEvent{
+					Topic:   schema.HelloTopic,
+					Payload: schema.SampleEvent{Name: exampleNames[rand.Intn(len(exampleNames))]},
+				})
+				if err != nil {
+					fmt.Println(err)
+				}
+			}
+		}
+	}()
+}
+
+// StopListening stops publishing events
+func (a *InMemoryPubSubAdapter) StopListening() error {
+	close(a.stopChannel)
+	return nil
+}
+
+// NotifyNewSubscription adds a subscriber to the map
+func (a *InMemoryPubSubAdapter) NotifyNewSubscription(ctx context.Context, subscriberData subscriptions.Data, queryData subscriptions.Query) error {
+	compoundKey := fmt.Sprintf("%v_%v", subscriberData.ClientID, subscriberData.SubscriptionID)
+	a.mux.Lock()
+	a.subscribers[compoundKey] = subscriptions.Request{Data: subscriberData, Query: queryData}
+	a.mux.Unlock()
+	return nil
+}
+
+// NotifyUnsubscribe removes a subscriber from the map
+func (a *InMemoryPubSubAdapter) NotifyUnsubscribe(ctx context.Context, subscriberData subscriptions.Data) error {
+	compoundKey := fmt.Sprintf("%v_%v", subscriberData.ClientID, subscriberData.SubscriptionID)
+	a.mux.Lock()
+	delete(a.subscribers, compoundKey)
+	a.mux.Unlock()
+	return nil
+}
+
+// NotifyClientConnect isn't useful information as everything is in memory, so just ignore it
+func (a *InMemoryPubSubAdapter) NotifyClientConnect(clientID string) error {
+	return nil
+}
+
+// NotifyClientDisconnect isn't useful information as everything is in memory, so just ignore it
+func (a *InMemoryPubSubAdapter) NotifyClientDisconnect(clientID string) error {
+	return nil
+}
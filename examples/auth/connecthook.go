@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/NickBlow/gqlssehandlers/credentials"
+)
+
+// SymmetricJWTConnectHook is an example connect hook, to be used as HandlerConfig.OnConnect, which authenticates
+// the user from a JWT in the authToken field of the GQL_INIT payload. The JWT is signed with a symmetric algorithm.
+// The user id is available from GetUserIDFromContext for the rest of the client's session,
+// and the client's streams are closed when the exp claim of the JWT passes
+func SymmetricJWTConnectHook(checkClaimsFunc CheckClaimsFunc, getSecretFunc GetSecretFunc) func(ctx context.Context, initPayload map[string]interface{}) (context.Context, error) {
+	return func(ctx context.Context, initPayload map[string]interface{}) (context.Context, error) {
+		authToken, _ := initPayload["authToken"].(string)
+		claims, err := decodeHeader(authToken, getSecretFunc())
+		if err != nil {
+			return nil, err
+		}
+		userID, err := checkClaimsFunc(claims)
+		if err != nil {
+			return nil, err
+		}
+		ctx = context.WithValue(ctx, userIDKey, userID)
+		if exp, ok := claims["exp"].(float64); ok {
+			ctx = credentials.WithExpiry(ctx, time.Unix(int64(exp), 0))
+		}
+		return ctx, nil
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"time"
 
 	"github.com/NickBlow/gqlssehandlers"
@@ -16,19 +19,23 @@ import (
 func main() {
 
 	router := mux.NewRouter()
-	eventStream := &adapters.InMemoryAdapter{}
+	eventStream := &adapters.InMemoryPubSubAdapter{}
 
 	subscriptionServerConfig := &gqlssehandlers.HandlerConfig{
-		Adapter: eventStream,
-		Schema:  &schema.HelloReactiveSchema,
+		Adapter:              eventStream,
+		Schema:               &schema.HelloTopicSchema,
+		ExecuteSubscriptions: true,
 	}
 
 	handlers := gqlssehandlers.GetHandlers(subscriptionServerConfig)
 	router.Handle("/", handlers.PublishStreamHandler).Methods("GET")
 	router.Handle("/subscribe", handlers.SubscribeHandler).Methods("POST")
+	router.Handle("/graphql/stream", handlers.DistinctConnectionsHandler).Methods("GET", "POST")
+	router.Handle("/graphql/single", handlers.SingleConnectionHandler).Methods("PUT", "GET", "POST", "DELETE")
+	router.Handle("/poll", handlers.LongPollHandler).Methods("GET")
 
 	originsOk := gorrilaHandlers.AllowedOrigins([]string{"https://example.com"})
-	methodsOk := gorrilaHandlers.AllowedMethods([]string{"GET", "POST", "OPTIONS"})
+	methodsOk := gorrilaHandlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
 
 	// Server has long write timeout because we're supporting a streaming response.
 	srv := http.Server{
@@ -38,7 +45,22 @@ func main() {
 		WriteTimeout: 15 * time.Minute,
 	}
 
+	go func() {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		<-interrupt
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// Close the streams first, otherwise srv.Shutdown would wait for them forever
+		if err := handlers.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+		srv.Shutdown(ctx)
+	}()
+
 	log.Printf("Server starting on port 8080")
-	log.Fatal(srv.ListenAndServe())
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 
 }
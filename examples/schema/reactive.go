@@ -10,7 +10,7 @@ import (
 
 // HelloReactiveSchema is a schema that resolves based on messages coming from a channel passed in via the context
 // It is intended to be run in a loop in a goroutine - the resolve function will block until something comes into the channel
-// Query is simply `{hello}`
+// Subscription is simply `subscription {hello}`
 var HelloReactiveSchema graphql.Schema
 
 type channelKeyType string
@@ -68,7 +68,11 @@ func init() {
 		},
 	}
 	var rootQuery = graphql.ObjectConfig{Name: "RootQuery", Fields: fields}
-	var schemaConfig = graphql.SchemaConfig{Query: graphql.NewObject(rootQuery)}
+	var rootSubscription = graphql.ObjectConfig{Name: "RootSubscription", Fields: fields}
+	var schemaConfig = graphql.SchemaConfig{
+		Query:        graphql.NewObject(rootQuery),
+		Subscription: graphql.NewObject(rootSubscription),
+	}
 	var schema, err = graphql.NewSchema(schemaConfig)
 	if err != nil {
 		fmt.Println(err)
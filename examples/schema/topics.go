@@ -0,0 +1,44 @@
+package schema
+
+import (
+	"fmt"
+
+	"github.com/NickBlow/gqlssehandlers/subscriptions"
+	"github.com/graphql-go/graphql"
+)
+
+// HelloTopicSchema is a schema for subscriptions executed by the library, see HandlerConfig.ExecuteSubscriptions.
+// The Subscribe resolver listens to the HelloTopic topic, and the Resolve function is called with each SampleEvent
+// published to it as the source
+// Subscription is simply `subscription {hello}`
+var HelloTopicSchema graphql.Schema
+
+// HelloTopic is the topic SampleEvents are published to
+const HelloTopic = "hello"
+
+func init() {
+	var fields = graphql.Fields{
+		"hello": &graphql.Field{
+			Type: graphql.String,
+			Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+				return subscriptions.Listen(p.Context, HelloTopic)
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				event, _ := p.Source.(SampleEvent)
+				return event.Name, nil
+			},
+		},
+	}
+	var rootQuery = graphql.ObjectConfig{Name: "RootQuery", Fields: fields}
+	var rootSubscription = graphql.ObjectConfig{Name: "RootSubscription", Fields: fields}
+	var schemaConfig = graphql.SchemaConfig{
+		Query:        graphql.NewObject(rootQuery),
+		Subscription: graphql.NewObject(rootSubscription),
+	}
+	var schema, err = graphql.NewSchema(schemaConfig)
+	if err != nil {
+		fmt.Println(err)
+		panic("Couldn't create schema")
+	}
+	HelloTopicSchema = schema
+}
@@ -47,25 +47,32 @@ func (d *DDBStore) StoreSubscriptionInDDB(subscriberData subscriptions.Data, que
 	if err != nil {
 		return err
 	}
+	item := map[string]*dynamodb.AttributeValue{
+		"TTL": {
+			N: aws.String(strconv.FormatInt(ttl, 10)),
+		},
+		"ClientID": {
+			S: aws.String(subscriberData.ClientID),
+		},
+		"SubscriptionID": {
+			S: aws.String(subscriberData.SubscriptionID),
+		},
+		"Variables": {
+			M: variables,
+		},
+		"QueryString": {
+			S: aws.String(queryData.RequestString),
+		},
+	}
+	// DynamoDB doesn't allow empty strings, so the operation name is only stored when there is one
+	if queryData.OperationName != "" {
+		item["OperationName"] = &dynamodb.AttributeValue{
+			S: aws.String(queryData.OperationName),
+		}
+	}
 	_, err = ddbSvc.PutItem(&dynamodb.PutItemInput{
 		TableName: aws.String(d.TableName),
-		Item: map[string]*dynamodb.AttributeValue{
-			"TTL": {
-				N: aws.String(strconv.FormatInt(ttl, 10)),
-			},
-			"ClientID": {
-				S: aws.String(subscriberData.ClientID),
-			},
-			"SubscriptionID": {
-				S: aws.String(subscriberData.SubscriptionID),
-			},
-			"Variables": {
-				M: variables,
-			},
-			"QueryString": {
-				S: aws.String(queryData.RequestString),
-			},
-		},
+		Item:      item,
 	})
 	return err
 }
@@ -4,10 +4,13 @@ go 1.12
 
 require (
 	github.com/aws/aws-sdk-go v1.20.5
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gorilla/handlers v1.4.0
 	github.com/gorilla/mux v1.7.2
-	github.com/graphql-go/graphql v0.7.8
+	github.com/graphql-go/graphql v0.8.1
 	github.com/matoous/go-nanoid v0.0.0-20190515092250-e998f83de84d
-	github.com/spf13/viper v1.4.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/testify v1.2.2 // indirect
+	golang.org/x/net v0.0.0-20190522155817-f3200d17e092 // indirect
 )
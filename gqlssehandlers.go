@@ -1,17 +1,31 @@
 // Package gqlssehandlers is a GraphQL Subscriptions over Server Sent Events library for Go.
-// It will create two handler endpoints that react to a subset of messages from the graphql-over-websocket protocol
-// (see subscriptions package)
+// It will create two handler endpoints that react to a subset of messages from the graphql-over-websocket protocol,
+// or the newer graphql-transport-ws protocol (see protocol package)
 package gqlssehandlers
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"runtime"
+	"sync"
+	"time"
 
 	"github.com/NickBlow/gqlssehandlers/callbacks"
 	"github.com/NickBlow/gqlssehandlers/clientid"
+	"github.com/NickBlow/gqlssehandlers/internal/distinctconnections"
+	"github.com/NickBlow/gqlssehandlers/internal/execution"
+	"github.com/NickBlow/gqlssehandlers/internal/longpolling"
 	"github.com/NickBlow/gqlssehandlers/internal/orchestration"
+	"github.com/NickBlow/gqlssehandlers/internal/quotas"
+	"github.com/NickBlow/gqlssehandlers/internal/ratelimit"
+	"github.com/NickBlow/gqlssehandlers/internal/sessions"
+	"github.com/NickBlow/gqlssehandlers/internal/singleconnection"
 	"github.com/NickBlow/gqlssehandlers/internal/streaming"
 	"github.com/NickBlow/gqlssehandlers/internal/subscriptionhandlers"
+	"github.com/NickBlow/gqlssehandlers/persistedqueries"
+	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/NickBlow/gqlssehandlers/replay"
 	"github.com/NickBlow/gqlssehandlers/subscriptions"
 	"github.com/graphql-go/graphql"
 )
@@ -32,10 +46,162 @@ type SubscriptionAdapter interface {
 	NotifyClientDisconnect(clientID string) error
 }
 
+// subscriptionStore is the part of a SubscriptionAdapter the handlers notify of new and stopped subscriptions
+type subscriptionStore interface {
+	NotifyNewSubscription(ctx context.Context, subscriberData subscriptions.Data, queryData subscriptions.Query) error
+	NotifyUnsubscribe(ctx context.Context, subscriberData subscriptions.Data) error
+}
+
+// BulkSubscriptionAdapter can optionally be implemented by a SubscriptionAdapter, to store the subscriptions started
+// by a batch of messages in one round trip. It should return an error, or nil, for each request, in the same order.
+type BulkSubscriptionAdapter interface {
+	NotifyNewSubscriptions(ctx context.Context, requests []subscriptions.Request) []error
+}
+
+// RawEventAdapter can optionally be implemented by a SubscriptionAdapter, to publish each domain event once instead of
+// a result for each interested subscription. If HandlerConfig.Filter or HandlerConfig.ExecuteSubscriptions is set,
+// StartListeningForRawEvents is called after StartListening. The callback runs the query of every active subscription
+// the Filter matches with the event, and sends the event to the executed subscriptions listening to its topic.
+type RawEventAdapter interface {
+	StartListeningForRawEvents(cb callbacks.RawEventCallback)
+}
+
+// ListeningStopper can optionally be implemented by a SubscriptionAdapter,
+// StopListening is called by Handlers.Shutdown and should stop the goroutines started by StartListening,
+// and by StartListeningForRawEvents for a RawEventAdapter.
+type ListeningStopper interface {
+	StopListening() error
+}
+
 // Handlers is a struct containing the generated handlers.
+// SubscribeHandler also accepts a JSON array of messages, and answers it with an array of {"id","status","result"}
+// objects in the same order, so each message succeeds or fails on its own.
+// PublishStreamHandler sends SSE, or multipart/mixed in the shape of Apollo's multipart subscription spec for clients
+// whose Accept header asks for it.
+// DistinctConnectionsHandler implements the graphql-sse "distinct connections" mode: a POST with a GraphQL request body,
+// or a GET with query, variables and operationName query strings, is answered with an event stream for just that
+// operation, ending with a complete event. It needs no client ID, so it is not wrapped in the clientid middleware.
+// SingleConnectionHandler implements the graphql-sse "single connection" mode, and should be mounted on a single
+// path for PUT, GET, POST and DELETE. It identifies clients by the stream token it issues rather than the clientid cookie.
+// LongPollHandler is a fallback for PublishStreamHandler, for clients behind proxies that buffer streamed responses.
+// Each GET is held until there are frames for the client, and answered with {"cursor":"...","messages":[...]}.
+// The client should send the cursor back in the cursor query string of its next poll.
 type Handlers struct {
-	SubscribeHandler     http.Handler
-	PublishStreamHandler http.Handler
+	SubscribeHandler           http.Handler
+	PublishStreamHandler       http.Handler
+	DistinctConnectionsHandler http.Handler
+	SingleConnectionHandler    http.Handler
+	LongPollHandler            http.Handler
+	broker                     *orchestration.Broker
+	adapter                    SubscriptionAdapter
+	engine                     *execution.Engine
+	stopReauthorizing          chan struct{}
+	stopOnce                   sync.Once
+}
+
+// Shutdown stops the adapter if it implements ListeningStopper, and the subscriptions run by ExecuteSubscriptions,
+// then stops accepting new streams and closes the open ones. Each stream is sent a protocol.MessageServerShutdown frame with an SSE retry hint of
+// HandlerConfig.ShutdownRetry, so browsers reconnect to another instance, and its queued frames are written out first.
+// NotifyClientDisconnect is called for each client as its last stream closes.
+// SSE responses never finish by themselves, so call this before http.Server.Shutdown.
+// It returns the context's error if the streams haven't all closed before it is done, and can be called again
+// to keep waiting. The adapter is only stopped by the first call, and an error from StopListening is returned
+// once the streams have closed.
+func (h *Handlers) Shutdown(ctx context.Context) error {
+	var stopErr error
+	h.stopOnce.Do(func() {
+		close(h.stopReauthorizing)
+		if stopper, ok := h.adapter.(ListeningStopper); ok {
+			stopErr = stopper.StopListening()
+		}
+		h.engine.Shutdown()
+	})
+	if err := h.broker.Shutdown(ctx); err != nil {
+		return err
+	}
+	return stopErr
+}
+
+// DeliveryStats counts the frames that were dropped or coalesced, and the streams that were disconnected,
+// because a client could not keep up. You can poll it to alert on slow consumers.
+type DeliveryStats = orchestration.DeliveryStats
+
+// DeliveryStats returns the delivery counters since the handlers were created
+func (h *Handlers) DeliveryStats() DeliveryStats {
+	return h.broker.Stats()
+}
+
+// DefaultReplayBufferSize is the number of frames kept per client for replay if HandlerConfig.ReplayBufferSize is not set
+const DefaultReplayBufferSize = 100
+
+// DefaultReplayRetention is how long frames are kept for replay if HandlerConfig.ReplayRetention is not set
+const DefaultReplayRetention = time.Minute * 5
+
+const replayTrimInterval = time.Second * 30
+
+// DefaultOutboundQueueSize is the number of frames that can be waiting to be written to a stream if HandlerConfig.OutboundQueueSize is not set
+const DefaultOutboundQueueSize = 64
+
+// DefaultShutdownRetry is the reconnect delay sent to clients on shutdown if HandlerConfig.ShutdownRetry is not set
+const DefaultShutdownRetry = time.Second
+
+// DefaultKeepAliveInterval is how often keepalives are sent on an idle stream if HandlerConfig.KeepAliveInterval is not set
+const DefaultKeepAliveInterval = time.Second * 15
+
+// DefaultLongPollTimeout is how long a poll is held waiting for frames if HandlerConfig.LongPollTimeout is not set
+const DefaultLongPollTimeout = time.Second * 25
+
+// DefaultPersistedQueryCacheSize is the number of persisted queries kept if HandlerConfig.PersistedQueryStore is not set
+const DefaultPersistedQueryCacheSize = 1000
+
+// DefaultSessionIdleTimeout is how long a client's session is kept without requests if HandlerConfig.SessionIdleTimeout is not set
+const DefaultSessionIdleTimeout = time.Hour
+
+// DefaultReauthorizeInterval is how often active subscriptions are authorized again if HandlerConfig.ReauthorizeInterval is not set
+const DefaultReauthorizeInterval = time.Minute
+
+// DefaultBrokerShards is the number of partitions client state is split across if HandlerConfig.BrokerShards is not set
+var DefaultBrokerShards = runtime.NumCPU()
+
+// OverflowPolicy decides what happens when a frame is sent to a stream whose outbound queue is full.
+// Frames replayed on reconnect and control frames are never dropped.
+type OverflowPolicy = orchestration.OverflowPolicy
+
+// The available overflow policies. Dropped frames are still kept by the ReplayStore.
+const (
+	// DropOldest discards the oldest queued frame to make room for the new one. This is the default.
+	DropOldest = orchestration.DropOldest
+	// DropNewest discards the new frame, keeping the ones already queued
+	DropNewest = orchestration.DropNewest
+	// CoalesceBySubscription keeps only the latest queued protocol.MessageData frame for each subscription, falling back to DropOldest
+	CoalesceBySubscription = orchestration.CoalesceBySubscription
+	// DisconnectSlowConsumer sends a protocol.MessageConnectionError frame and closes the stream
+	DisconnectSlowConsumer = orchestration.DisconnectSlowConsumer
+)
+
+// ConnectionPolicy decides what happens when a client opens a stream while it already has one open,
+// for example when the default cookie is shared between browser tabs.
+type ConnectionPolicy = orchestration.ConnectionPolicy
+
+// The available connection policies. NotifyClientConnect and NotifyClientDisconnect are only called for the
+// first stream a client opens and the last one it closes, whatever the policy.
+const (
+	// FanOut keeps every stream open and sends each frame to all of them. This is the default.
+	FanOut = orchestration.FanOut
+	// KeepNewest sends the older streams a protocol.MessageConnectionTerminate frame and closes them
+	KeepNewest = orchestration.KeepNewest
+	// RejectNewest refuses the new stream with a 409 Conflict, leaving the existing one open
+	RejectNewest = orchestration.RejectNewest
+)
+
+// RateLimit is a token bucket rate: PerSecond requests are allowed per second, with bursts of up to Burst requests.
+// The zero value is no limit
+type RateLimit = ratelimit.Rate
+
+// RemoteIPRateLimitKey can be used as HandlerConfig.RateLimitKey to rate limit by the IP address a request came from.
+// Behind a proxy, write your own key function that reads the address the proxy forwards
+func RemoteIPRateLimitKey(r *http.Request) string {
+	return ratelimit.RemoteIP(r)
 }
 
 // HandlerConfig represesents the configuration options for GQLSSEHandlers
@@ -43,32 +209,385 @@ type Handlers struct {
 type HandlerConfig struct {
 	Adapter SubscriptionAdapter
 	Schema  *graphql.Schema
+	// ReplayStore keeps the frames sent to each client so they can be replayed when an EventSource reconnects
+	// with a Last-Event-ID header. Frames are kept while the client is disconnected.
+	// It defaults to an in-memory store bounded by ReplayBufferSize and ReplayRetention,
+	// use a replay.FileStore or your own implementation if frames need to survive a restart.
+	ReplayStore      replay.Store
+	ReplayBufferSize int
+	ReplayRetention  time.Duration
+	// ConnectionPolicy decides what happens when a client opens a stream while it already has one open
+	ConnectionPolicy ConnectionPolicy
+	// OutboundQueueSize is the number of frames each stream can have waiting, so a slow client never holds up the others
+	OutboundQueueSize int
+	// OverflowPolicy decides what to do when a stream's outbound queue fills up
+	OverflowPolicy OverflowPolicy
+	// BrokerShards is the number of partitions connected clients are split across, each handled by its own goroutine
+	BrokerShards int
+	// ShutdownRetry is how long clients are told to wait before reconnecting when their stream is closed by Handlers.Shutdown
+	ShutdownRetry time.Duration
+	// Protocol is the message protocol both endpoints speak, protocol.Legacy or protocol.TransportWS. If it is nil,
+	// the subscribe endpoint detects the protocol from each message, and the streaming endpoint uses the one named in
+	// the protocol.ProtocolQueryString, defaulting to protocol.Legacy.
+	Protocol protocol.Protocol
+	// LongPollTimeout is how long the LongPollHandler holds a poll waiting for frames before answering with none
+	LongPollTimeout time.Duration
+	// KeepAliveInterval is how long a stream can be idle before a keepalive is sent on it
+	KeepAliveInterval time.Duration
+	// CommentKeepAlives sends keepalives as ": ping" comment lines instead of keepalive messages.
+	// It only applies to SSE from the PublishStreamHandler, as do NamedEvents and InitialRetry
+	CommentKeepAlives bool
+	// NamedEvents sets the SSE event field of each message to its type in the stream's protocol, such as GQL_COMPLETE
+	// or complete, so browsers can use addEventListener
+	NamedEvents bool
+	// InitialRetry, if set, is sent as a retry hint when a stream opens
+	InitialRetry time.Duration
+	// Limits bounds the depth, complexity and number of aliases of the subscriptions clients can start. Subscriptions
+	// over a limit are refused with an error saying which one, before the Adapter is notified. The zero value has no limits.
+	Limits protocol.Limits
+	// PersistedQueryStore keeps the queries of automatic persisted queries, so clients can start a subscription with just
+	// the query's hash. It defaults to a persistedqueries.MemoryStore of DefaultPersistedQueryCacheSize queries.
+	PersistedQueryStore persistedqueries.Store
+	// PersistedQueriesOnly only accepts hashes already in the store, so pass a persistedqueries.Manifest
+	// as the store to only allow the subscriptions your clients were built with
+	PersistedQueriesOnly bool
+	// MaxSubscriptionsPerClient and MaxSubscriptionsPerUser limit the number of active subscriptions, and a start over
+	// either is refused with a 429. The SingleConnectionHandler counts each stream token as a client, and the
+	// DistinctConnectionsHandler counts each remote address as one.
+	// A subscription stops counting when it is stopped, when the Adapter sends an event with Finished set,
+	// or when its client has had no stream open for ReconnectTimeout. Zero means no limit.
+	MaxSubscriptionsPerClient int
+	MaxSubscriptionsPerUser   int
+	// UserFromContext identifies the user of a request for MaxSubscriptionsPerUser. It is passed the request context
+	// and should return an empty string for anonymous requests
+	UserFromContext func(ctx context.Context) string
+	// StartRateLimit and StopRateLimit limit the rate of start and stop messages to the SubscribeHandler, and
+	// ConnectRateLimit the rate of new streams on the PublishStreamHandler, each with its own budget. Requests over
+	// a limit are refused with a 429 and a Retry-After header.
+	// The SingleConnectionHandler counts reserving a stream token as a connect, and its operations as starts and stops.
+	// The DistinctConnectionsHandler counts each request as both a connect and a start.
+	StartRateLimit   RateLimit
+	StopRateLimit    RateLimit
+	ConnectRateLimit RateLimit
+	// RateLimitKey decides who requests are counted against by the rate limits, and defaults to the client ID.
+	// Requests to the graphql-sse handlers that have no client ID yet default to the remote IP address
+	RateLimitKey func(r *http.Request) string
+	// ClientIDProvider decides where client IDs are read from and how they are issued. It defaults to a
+	// clientid.CookieProvider, see also clientid.HeaderProvider and clientid.PerTabProvider.
+	ClientIDProvider clientid.Provider
+	// ClientIDSigner, if set, signs the client IDs issued by the handlers and rejects requests whose client ID it didn't sign.
+	// It wraps the ClientIDProvider unless it has a Provider of its own, and must have at least one key.
+	// Only the built in providers can be wrapped, and GetHandlers panics if the Provider is any other.
+	ClientIDSigner *clientid.Signer
+	// OnConnect, if set, authenticates clients when they send GQL_INIT, see ConnectHook. Clients then have to send
+	// GQL_INIT before anything else, and open streams after it. Client IDs are then only issued in answer to GQL_INIT
+	// once OnConnect has run, and the ClientIDSigner's UserFromContext is given the session's values.
+	// Streams are closed with a GQL_CREDENTIALS_EXPIRED frame when the credentials expiry set on their context with
+	// credentials.WithExpiry passes, and sessions with expired credentials are ended.
+	// A client whose session has ended only keeps its client ID when it sends GQL_INIT again if the ClientIDSigner has
+	// a UserFromContext and the ID was issued to the new session's user. Otherwise the subscriptions of its old ID are
+	// ended straight away, and it has to start them again with the new ID it is issued.
+	// The graphql-sse protocol has no GQL_INIT, so the DistinctConnectionsHandler calls OnConnect with a nil payload
+	// for each request, and the SingleConnectionHandler when each stream token is reserved. Credentials for them have
+	// to be read from the request context, for example from a header by your own middleware.
+	OnConnect ConnectHook
+	// SessionIdleTimeout ends the session of a client that has made no requests for that long. A session also ends
+	// when its client sends GQL_CONNECTION_TERMINATE
+	SessionIdleTimeout time.Duration
+	// AuthorizeSubscription, if set, decides whether each subscription may be started, see AuthorizeHook
+	AuthorizeSubscription AuthorizeHook
+	// ReauthorizeSubscription, if set, is called with every active subscription started through the SubscribeHandler
+	// each ReauthorizeInterval. Subscriptions it refuses are ended with a GQL_ERROR frame on the client's stream,
+	// and NotifyUnsubscribe is called for them. Its context has the values of the client's latest session.
+	ReauthorizeSubscription AuthorizeHook
+	ReauthorizeInterval     time.Duration
+	// ReconnectTimeout is how long a client's subscriptions are kept for reauthorization, filtering and execution
+	// after its last stream closes, so they outlive a reconnect. It defaults to the ReplayRetention
+	ReconnectTimeout time.Duration
+	// Filter, if set, decides which subscriptions started through the SubscribeHandler each raw event from a
+	// RawEventAdapter applies to, see FilterHook. It can't be used with ExecuteSubscriptions, which runs them already.
+	// Only the subscriptions started on this server are filtered, so the Adapter should publish each event to every server.
+	// The queries of the matched subscriptions are executed one after another with graphql.Do on the goroutine that
+	// called the RawEventCallback, so slow resolvers hold up the events after it. The event is passed to the resolvers
+	// in their context, and its Payload is also the root object, read from p.Source, if it is a map[string]interface{}.
+	Filter FilterHook
+	// ExecuteSubscriptions makes the library execute the subscriptions stored by the Adapter, from all the handlers,
+	// with the Subscribe resolvers of the Schema. A resolver listens to topics by returning subscriptions.Listen, and the
+	// query is executed with the payload of each raw event published to them as the root value. The Adapter then only has
+	// to store subscriptions and implement RawEventAdapter, and should publish each event to every server, as
+	// subscriptions are executed by the server they were started on. A client's subscribe requests and streams must then
+	// reach the same server, for example with sticky sessions on the client ID. A subscription runs until it is stopped,
+	// or until its client has had no stream open for ReconnectTimeout, when NotifyUnsubscribe is called for it.
+	// It is completed when its resolver's channel is closed, and NotifyUnsubscribe is called for it.
+	// Publishing never waits for a resolver: each has OutboundQueueSize raw events waiting for it, and the
+	// OverflowPolicy applies when they are full, DisconnectSlowConsumer completing the subscription.
+	// Handlers.Shutdown stops every subscription, leaving them in the Adapter.
+	ExecuteSubscriptions bool
 }
 
+// AuthorizeHook is called with every valid subscription before NotifyNewSubscription, on all the handlers that start
+// subscriptions. It returns an error to refuse the subscription with a GQL_ERROR with the protocol.Forbidden code.
+// The context is the one NotifyNewSubscription would get, and the parsed document and operation are available from
+// subscriptions.ParsedQueryFromContext, so the fields and arguments can be checked alongside the variables.
+type AuthorizeHook func(ctx context.Context, subscriberData subscriptions.Data, queryData subscriptions.Query) error
+
+// FilterHook is called with every active subscription for each raw event, and returns whether the event applies to it,
+// for example by comparing the event's Topic and Payload with the subscription's variables. The query is then executed
+// for the subscriptions it matches, with the event available to resolvers from subscriptions.RawEventFromContext,
+// and its Payload as the root object if it is a map[string]interface{}.
+// The context has the values the subscription was started with, updated by the client's latest session.
+// It is called from the adapter's goroutine, so it should be quick.
+// Only subscriptions started through the SubscribeHandler are filtered. Operations on the DistinctConnectionsHandler
+// and SingleConnectionHandler only get the events the Adapter sends them, or use ExecuteSubscriptions instead.
+type FilterHook func(ctx context.Context, subscriberData subscriptions.Data, queryData subscriptions.Query, rawEvent subscriptions.RawEvent) bool
+
+// ConnectHook is called with the request context and the payload of each GQL_INIT message. It returns a context
+// with values such as the user ID, tenant or roles, or an error to reject the client with a GQL_ERROR.
+// The values are kept against the client ID, and added to the context of every later request from the client,
+// including the one passed to NotifyNewSubscription and NotifyUnsubscribe. Only the values of the returned context are
+// kept, its deadline and cancellation are not.
+type ConnectHook func(ctx context.Context, initPayload map[string]interface{}) (context.Context, error)
+
 // GetHandlers returns all the handlers required to set up the GraphQL subscription.
-// The handlers have a concept of client ID, and will by default set a cookie with a client id and use that.
-// This default is not safe across multiple browser windows/tabs,
-// and while the id uses a strong random number generator, it is not signed.
+// The handlers have a concept of client ID, and will by default set a cookie with a client id and use that,
+// unless HandlerConfig.ClientIDProvider says otherwise.
+// This default is shared across multiple browser windows/tabs, see ConnectionPolicy for how that is handled,
+// and while the id uses a strong random number generator, it is not signed unless HandlerConfig.ClientIDSigner is set.
 // You can write middleware to set the ClientIDKey in the context to overwrite this default behaviour
 // See the clientid package for more information.
 func GetHandlers(config *HandlerConfig) *Handlers {
+	replayBufferSize := config.ReplayBufferSize
+	if replayBufferSize == 0 {
+		replayBufferSize = DefaultReplayBufferSize
+	}
+	replayRetention := config.ReplayRetention
+	if replayRetention == 0 {
+		replayRetention = DefaultReplayRetention
+	}
+	replayStore := config.ReplayStore
+	if replayStore == nil {
+		replayStore = replay.NewMemoryStore(replayBufferSize, replayRetention)
+	}
+	outboundQueueSize := config.OutboundQueueSize
+	if outboundQueueSize == 0 {
+		outboundQueueSize = DefaultOutboundQueueSize
+	}
+	brokerShards := config.BrokerShards
+	if brokerShards == 0 {
+		brokerShards = DefaultBrokerShards
+	}
+	shutdownRetry := config.ShutdownRetry
+	if shutdownRetry == 0 {
+		shutdownRetry = DefaultShutdownRetry
+	}
+	longPollTimeout := config.LongPollTimeout
+	if longPollTimeout == 0 {
+		longPollTimeout = DefaultLongPollTimeout
+	}
+	keepAliveInterval := config.KeepAliveInterval
+	if keepAliveInterval == 0 {
+		keepAliveInterval = DefaultKeepAliveInterval
+	}
+	persistedQueryStore := config.PersistedQueryStore
+	if persistedQueryStore == nil {
+		persistedQueryStore = persistedqueries.NewMemoryStore(DefaultPersistedQueryCacheSize)
+	}
+	persistedQueries := &persistedqueries.Resolver{
+		Store:  persistedQueryStore,
+		Strict: config.PersistedQueriesOnly,
+	}
+	brokerOptions := orchestration.Options{
+		ReplayStore:        replayStore,
+		ReplayTrimInterval: replayTrimInterval,
+		ConnectionPolicy:   config.ConnectionPolicy,
+		OutboundQueueSize:  outboundQueueSize,
+		OverflowPolicy:     config.OverflowPolicy,
+		Shards:             brokerShards,
+		ShutdownRetry:      shutdownRetry,
+	}
+	var clientIDProvider clientid.Provider = &clientid.CookieProvider{}
+	if config.ClientIDProvider != nil {
+		clientIDProvider = config.ClientIDProvider
+	}
+	unverifiedProvider := clientIDProvider
+	if config.ClientIDSigner != nil {
+		if len(config.ClientIDSigner.Keys) == 0 {
+			panic("HandlerConfig.ClientIDSigner needs at least one key")
+		}
+		signer := *config.ClientIDSigner
+		if signer.Provider == nil {
+			signer.Provider = clientIDProvider
+		}
+		if !clientid.CanDeliver(signer.Provider) {
+			panic("HandlerConfig.ClientIDSigner can only wrap the built in client ID providers")
+		}
+		unverifiedProvider = signer.Provider
+		clientIDProvider = &signer
+	}
+	var sessionStore *sessions.Store
+	if config.OnConnect != nil {
+		sessionIdleTimeout := config.SessionIdleTimeout
+		if sessionIdleTimeout == 0 {
+			sessionIdleTimeout = DefaultSessionIdleTimeout
+		}
+		sessionStore = sessions.NewStore(sessionIdleTimeout)
+		clientIDProvider = &sessions.Provider{
+			Provider:   clientIDProvider,
+			Unverified: unverifiedProvider,
+			BindsUsers: config.ClientIDSigner != nil && config.ClientIDSigner.UserFromContext != nil,
+			Store:      sessionStore,
+		}
+	}
+	var subscriptionQuotas *quotas.Quotas
+	if config.MaxSubscriptionsPerClient > 0 || config.MaxSubscriptionsPerUser > 0 {
+		subscriptionQuotas = &quotas.Quotas{
+			MaxPerClient:    config.MaxSubscriptionsPerClient,
+			MaxPerUser:      config.MaxSubscriptionsPerUser,
+			UserFromContext: config.UserFromContext,
+		}
+	}
+	var active *subscriptionhandlers.ActiveSubscriptions
+	if config.ReauthorizeSubscription != nil || config.Filter != nil || config.OnConnect != nil {
+		active = &subscriptionhandlers.ActiveSubscriptions{}
+	}
+	var engine *execution.Engine
+	var store subscriptionStore = config.Adapter
+	if config.ExecuteSubscriptions {
+		if config.Filter != nil {
+			panic("HandlerConfig.Filter can't be used with ExecuteSubscriptions, as each subscription would run twice")
+		}
+		engine = &execution.Engine{
+			Schema:         config.Schema,
+			Adapter:        config.Adapter,
+			QueueSize:      outboundQueueSize,
+			OverflowPolicy: config.OverflowPolicy,
+		}
+		store = engine
+	}
+	reconnectTimeout := config.ReconnectTimeout
+	if reconnectTimeout == 0 {
+		reconnectTimeout = replayRetention
+	}
+	reconnectWindow := &orchestration.ReconnectWindow{
+		Timeout: reconnectTimeout,
+		Expire: func(clientID string) {
+			engine.StopClient(clientID)
+			subscriptionQuotas.ReleaseClient(clientID)
+			active.ReleaseClient(clientID)
+		},
+	}
 	subscriptionBroker := orchestration.InitializeBroker(
 		config.Schema,
-		config.Adapter.NotifyClientConnect,
-		config.Adapter.NotifyClientDisconnect,
+		func(clientID string) error {
+			reconnectWindow.Connected(clientID)
+			return config.Adapter.NotifyClientConnect(clientID)
+		},
+		func(clientID string) error {
+			reconnectWindow.Disconnected(clientID)
+			return config.Adapter.NotifyClientDisconnect(clientID)
+		},
+		brokerOptions,
 	)
-	config.Adapter.StartListening(subscriptionBroker.PushDataToClient)
+	pushEvent := func(event subscriptions.WrappedEvent) error {
+		if event.Finished {
+			subscriptionQuotas.Release(event.ClientID, event.SubscriptionID)
+			active.Release(event.ClientID, event.SubscriptionID)
+		}
+		return subscriptionBroker.PushDataToClient(event)
+	}
+	config.Adapter.StartListening(pushEvent)
+	if engine != nil {
+		engine.Push = pushEvent
+	}
 
 	subscribeHandler := &subscriptionhandlers.Handler{
-		Broker:         subscriptionBroker,
-		StorageAdapter: config.Adapter,
+		Broker:                  subscriptionBroker,
+		StorageAdapter:          store,
+		Protocol:                config.Protocol,
+		Limits:                  config.Limits,
+		PersistedQueries:        persistedQueries,
+		Quotas:                  subscriptionQuotas,
+		StartLimiter:            ratelimit.New(config.StartRateLimit),
+		StopLimiter:             ratelimit.New(config.StopRateLimit),
+		RateLimitKey:            config.RateLimitKey,
+		ClientIDProvider:        clientIDProvider,
+		OnConnect:               config.OnConnect,
+		Sessions:                sessionStore,
+		AuthorizeSubscription:   config.AuthorizeSubscription,
+		ReauthorizeSubscription: config.ReauthorizeSubscription,
+		Active:                  active,
+		Filter:                  config.Filter,
+	}
+	if config.Filter != nil || engine != nil {
+		if rawEventAdapter, ok := config.Adapter.(RawEventAdapter); ok {
+			rawEventAdapter.StartListeningForRawEvents(func(event subscriptions.RawEvent) error {
+				if engine != nil {
+					if err := engine.Publish(event); err != nil {
+						return err
+					}
+				}
+				if config.Filter != nil {
+					return subscribeHandler.PublishRawEvent(event)
+				}
+				return nil
+			})
+		} else {
+			fmt.Println("HandlerConfig.Filter or ExecuteSubscriptions is set, but the Adapter does not implement RawEventAdapter")
+		}
+	}
+	stopReauthorizing := make(chan struct{})
+	if config.ReauthorizeSubscription != nil {
+		reauthorizeInterval := config.ReauthorizeInterval
+		if reauthorizeInterval == 0 {
+			reauthorizeInterval = DefaultReauthorizeInterval
+		}
+		go subscribeHandler.Reauthorize(reauthorizeInterval, stopReauthorizing)
 	}
 
 	publishStreamHandler := &streaming.Handler{
-		Broker: subscriptionBroker,
+		Broker:            subscriptionBroker,
+		Protocol:          config.Protocol,
+		KeepAliveInterval: keepAliveInterval,
+		SSE: streaming.SSEOptions{
+			CommentKeepAlives: config.CommentKeepAlives,
+			NamedEvents:       config.NamedEvents,
+			InitialRetry:      config.InitialRetry,
+		},
+		ConnectLimiter: ratelimit.New(config.ConnectRateLimit),
+		RateLimitKey:   config.RateLimitKey,
+	}
+	distinctConnectionsHandler := &distinctconnections.Handler{
+		Broker:                subscriptionBroker,
+		StorageAdapter:        store,
+		KeepAliveInterval:     keepAliveInterval,
+		Limits:                config.Limits,
+		PersistedQueries:      persistedQueries,
+		Quotas:                subscriptionQuotas,
+		ConnectLimiter:        ratelimit.New(config.ConnectRateLimit),
+		StartLimiter:          ratelimit.New(config.StartRateLimit),
+		RateLimitKey:          config.RateLimitKey,
+		OnConnect:             config.OnConnect,
+		AuthorizeSubscription: config.AuthorizeSubscription,
 	}
+	singleConnectionHandler := singleconnection.NewHandler(subscriptionBroker, store, keepAliveInterval, config.Limits, persistedQueries)
+	singleConnectionHandler.Quotas = subscriptionQuotas
+	singleConnectionHandler.ConnectLimiter = ratelimit.New(config.ConnectRateLimit)
+	singleConnectionHandler.StartLimiter = ratelimit.New(config.StartRateLimit)
+	singleConnectionHandler.StopLimiter = ratelimit.New(config.StopRateLimit)
+	singleConnectionHandler.RateLimitKey = config.RateLimitKey
+	singleConnectionHandler.OnConnect = config.OnConnect
+	singleConnectionHandler.AuthorizeSubscription = config.AuthorizeSubscription
+	clientIDMiddleware := clientid.ProviderMiddleware(clientIDProvider, config.Protocol)
+	sessionMiddleware := sessions.Middleware(sessionStore, config.Protocol)
 	return &Handlers{
-		SubscribeHandler:     clientid.Middleware(subscribeHandler),
-		PublishStreamHandler: clientid.Middleware(publishStreamHandler),
+		SubscribeHandler:           clientIDMiddleware(subscribeHandler),
+		PublishStreamHandler:       clientIDMiddleware(sessionMiddleware(publishStreamHandler)),
+		DistinctConnectionsHandler: distinctConnectionsHandler,
+		SingleConnectionHandler:    singleConnectionHandler,
+		LongPollHandler:            clientIDMiddleware(sessionMiddleware(longpolling.NewHandler(subscriptionBroker, config.Protocol, longPollTimeout))),
+		broker:                     subscriptionBroker,
+		adapter:                    config.Adapter,
+		engine:                     engine,
+		stopReauthorizing:          stopReauthorizing,
 	}
 }
@@ -0,0 +1,256 @@
+package distinctconnections
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/NickBlow/gqlssehandlers/internal/orchestration"
+	"github.com/NickBlow/gqlssehandlers/internal/quotas"
+	"github.com/NickBlow/gqlssehandlers/internal/ratelimit"
+	"github.com/NickBlow/gqlssehandlers/internal/sessions"
+	"github.com/NickBlow/gqlssehandlers/persistedqueries"
+	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/NickBlow/gqlssehandlers/replay"
+	"github.com/NickBlow/gqlssehandlers/subscriptions"
+	gonanoid "github.com/matoous/go-nanoid"
+)
+
+type subscriptionStorageAdapter interface {
+	NotifyNewSubscription(ctx context.Context, subscriberData subscriptions.Data, queryData subscriptions.Query) error
+	NotifyUnsubscribe(ctx context.Context, subscriberData subscriptions.Data) error
+}
+
+// Handler handles the graphql-sse "distinct connections" endpoint, where each request carries a single operation
+// and the response is the event stream for just that operation. Each request gets its own generated client ID.
+// A comment is sent whenever nothing has been written for KeepAliveInterval.
+// AuthorizeSubscription, if set, is called with each valid operation before it is stored, and refuses it by returning an error.
+// As every request is a new client, Quotas counts the operations open from each remote address as one client's.
+// Each request counts against both ConnectLimiter and StartLimiter, by the RateLimitKey or else the remote address.
+// OnConnect, if set, is called with the request context and no payload for each request, as the protocol has no
+// init message, and the values of the context it returns are added to the contexts the operation is handled with
+type Handler struct {
+	Broker                *orchestration.Broker
+	StorageAdapter        subscriptionStorageAdapter
+	KeepAliveInterval     time.Duration
+	Limits                protocol.Limits
+	PersistedQueries      *persistedqueries.Resolver
+	Quotas                *quotas.Quotas
+	ConnectLimiter        *ratelimit.Limiter
+	StartLimiter          *ratelimit.Limiter
+	RateLimitKey          ratelimit.KeyFunc
+	OnConnect             func(ctx context.Context, initPayload map[string]interface{}) (context.Context, error)
+	AuthorizeSubscription func(ctx context.Context, subscriberData subscriptions.Data, queryData subscriptions.Query) error
+}
+
+// readPayload reads the operation from the body of a POST, or the query string of a GET
+func readPayload(r *http.Request) (*protocol.GQLStartPayload, error) {
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		payload := &protocol.GQLStartPayload{
+			Query:         query.Get("query"),
+			OperationName: query.Get("operationName"),
+		}
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &payload.Variables); err != nil {
+				return nil, err
+			}
+		}
+		if extensions := query.Get("extensions"); extensions != "" {
+			if err := json.Unmarshal([]byte(extensions), &payload.Extensions); err != nil {
+				return nil, err
+			}
+		}
+		return payload, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	message, err := protocol.GraphQLSSE.Decode(body)
+	if err != nil {
+		return nil, err
+	}
+	var payload protocol.GQLStartPayload
+	if err := json.Unmarshal(message.Payload, &payload); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
+
+func writeResponse(w http.ResponseWriter, res *protocol.Response) {
+	for k, v := range res.ExtraHeaders {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.StatusCode)
+	w.Write(res.Message)
+}
+
+// writeEvent writes a single SSE event with the given name
+func writeEvent(w http.ResponseWriter, event string, data []byte) {
+	fmt.Fprintf(w, "event:%v\ndata:%v\n\n", event, string(data))
+}
+
+func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
+	key := ratelimit.KeyOrRemoteIP(r, s.RateLimitKey)
+	for _, limiter := range []*ratelimit.Limiter{s.ConnectLimiter, s.StartLimiter} {
+		if allowed, retryAfter := limiter.Allow(key); !allowed {
+			writeResponse(w, protocol.TooManyRequestsResponse(protocol.GraphQLSSE, retryAfter))
+			return
+		}
+	}
+	payload, err := readPayload(r)
+	if err != nil {
+		fmt.Println(err)
+		writeResponse(w, protocol.BadRequestResponseFor(protocol.GraphQLSSE))
+		return
+	}
+	if resolveResponse := s.PersistedQueries.Resolve(protocol.GraphQLSSE, payload); resolveResponse != nil {
+		writeResponse(w, resolveResponse)
+		return
+	}
+	parsed, validationResponse := protocol.ValidatePayloadFor(protocol.GraphQLSSE, *payload, s.Broker.Schema, s.Limits)
+	if validationResponse != nil {
+		writeResponse(w, validationResponse)
+		return
+	}
+	// the adapter is still told of the operation ending after the request context is cancelled
+	unsubscribeCtx := context.Background()
+	if s.OnConnect != nil {
+		session, err := s.OnConnect(r.Context(), nil)
+		if err != nil {
+			writeResponse(w, protocol.ConnectionRejectedResponse(protocol.GraphQLSSE, err))
+			return
+		}
+		r = r.WithContext(sessions.WithSession(r.Context(), session))
+		unsubscribeCtx = sessions.WithSession(unsubscribeCtx, session)
+	}
+	clientID, err := gonanoid.Nanoid()
+	if err != nil {
+		fmt.Println("Couldn't generate client ID")
+		writeResponse(w, protocol.ServerErrorResponseFor(protocol.GraphQLSSE))
+		return
+	}
+	subscriberData := subscriptions.Data{
+		SubscriptionID: clientID,
+		ClientID:       clientID,
+	}
+	queryData := subscriptions.Query{
+		RequestString:  payload.Query,
+		VariableValues: payload.Variables,
+		OperationName:  payload.OperationName,
+	}
+	if s.AuthorizeSubscription != nil {
+		if err := s.AuthorizeSubscription(subscriptions.WithParsedQuery(r.Context(), parsed), subscriberData, queryData); err != nil {
+			writeResponse(w, protocol.ForbiddenResponse(protocol.GraphQLSSE, err))
+			return
+		}
+	}
+	host := ratelimit.RemoteIP(r)
+	if _, quotaResponse := s.Quotas.Acquire(r.Context(), protocol.GraphQLSSE, host, clientID); quotaResponse != nil {
+		writeResponse(w, quotaResponse)
+		return
+	}
+	// the operation ends with the request, however it ends
+	defer s.Quotas.Release(host, clientID)
+	clientInfo := orchestration.ClientInfo{
+		ClientID:     clientID,
+		ConnectionID: clientID,
+		Outbox:       s.Broker.NewOutbox(),
+		CloseChannel: make(chan bool, 1),
+	}
+	if err := s.Broker.Connect(clientInfo); err != nil {
+		writeResponse(w, protocol.ShuttingDownResponseFor(protocol.GraphQLSSE))
+		return
+	}
+	defer s.Broker.Disconnected(clientInfo)
+	err = s.StorageAdapter.NotifyNewSubscription(r.Context(), subscriberData, queryData)
+	if err != nil {
+		fmt.Println(err)
+		writeResponse(w, protocol.BadRequestResponseFor(protocol.GraphQLSSE))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if completed := s.stream(r.Context(), w, flusher, clientInfo); !completed {
+		s.StorageAdapter.NotifyUnsubscribe(unsubscribeCtx, subscriberData)
+	}
+}
+
+// stream writes the operation's results until it completes, the request is cancelled or the broker closes the stream.
+// It returns true if the operation completed
+func (s *Handler) stream(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, clientInfo orchestration.ClientInfo) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-clientInfo.CloseChannel:
+			// the frames queued before the broker closed the stream are still written out
+			_, completed := writeQueued(w, flusher, clientInfo.Outbox)
+			return completed
+		case <-time.After(s.KeepAliveInterval):
+			fmt.Fprint(w, ":\n\n")
+			flusher.Flush()
+		case <-clientInfo.Outbox.Ready():
+			if ended, completed := writeQueued(w, flusher, clientInfo.Outbox); ended {
+				return completed
+			}
+		}
+	}
+}
+
+// writeQueued writes the frames queued on the outbox, stopping at one that ends the stream.
+// It returns whether the stream ended, and whether that was because the operation completed
+func writeQueued(w http.ResponseWriter, flusher http.Flusher, outbox *orchestration.Outbox) (bool, bool) {
+	defer flusher.Flush()
+	for _, frame := range outbox.Drain() {
+		if done := writeFrame(w, frame); done {
+			return true, frame.Type == protocol.MessageComplete
+		}
+	}
+	return false, false
+}
+
+// writeNext writes the frame's payload as a next event
+func writeNext(w http.ResponseWriter, frame replay.Frame) {
+	data, err := protocol.GraphQLSSE.Encode(&protocol.Message{Type: protocol.MessageData, Payload: frame.Payload})
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("Could not marshall frame")
+		return
+	}
+	writeEvent(w, protocol.GraphQLSSENext, data)
+}
+
+// writeFrame writes a next or complete event for the frame, and returns true if the stream should end.
+// A complete frame carrying a final result gets a next event for it first
+func writeFrame(w http.ResponseWriter, frame replay.Frame) bool {
+	switch frame.Type {
+	case protocol.MessageData:
+		writeNext(w, frame)
+		return false
+	case protocol.MessageComplete:
+		if len(frame.Payload) > 0 && string(frame.Payload) != "null" {
+			writeNext(w, frame)
+		}
+		writeEvent(w, protocol.GraphQLSSEComplete, nil)
+		return true
+	case protocol.MessageConnectionTerminate, protocol.MessageConnectionError, protocol.MessageServerShutdown:
+		return true
+	default:
+		return false
+	}
+}
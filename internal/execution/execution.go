@@ -0,0 +1,316 @@
+// Package execution runs subscriptions with the Subscribe resolvers of a graphql-go schema, so adapters only have to
+// store subscriptions and publish raw events
+package execution
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/NickBlow/gqlssehandlers/callbacks"
+	"github.com/NickBlow/gqlssehandlers/internal/orchestration"
+	"github.com/NickBlow/gqlssehandlers/internal/sessions"
+	"github.com/NickBlow/gqlssehandlers/subscriptions"
+	"github.com/graphql-go/graphql"
+)
+
+type subscriptionStorageAdapter interface {
+	NotifyNewSubscription(ctx context.Context, subscriberData subscriptions.Data, queryData subscriptions.Query) error
+	NotifyUnsubscribe(ctx context.Context, subscriberData subscriptions.Data) error
+}
+
+type bulkSubscriptionStorageAdapter interface {
+	NotifyNewSubscriptions(ctx context.Context, requests []subscriptions.Request) []error
+}
+
+// run is a subscription being executed, with the values of the context it was started with
+type run struct {
+	cancel     context.CancelFunc
+	data       subscriptions.Data
+	values     context.Context
+	overflowed int32
+}
+
+type runKeyType struct{}
+
+var runKey runKeyType
+
+// listener is a Subscribe resolver waiting for the raw events of its topics
+type listener struct {
+	events  chan interface{}
+	done    <-chan struct{}
+	started *run
+}
+
+// Engine wraps the storage adapter the handlers notify of subscriptions. Each subscription the Adapter stores is
+// executed with graphql.Subscribe until it is stopped, its client is gone, or its Subscribe resolver ends it.
+// Every result is sent to Push, followed by an event with Finished set if the subscription ended by itself.
+// Each resolver can have QueueSize raw events waiting for it, and OverflowPolicy decides what happens to the events
+// published while its queue is full. DisconnectSlowConsumer ends the subscription
+type Engine struct {
+	Schema         *graphql.Schema
+	Adapter        subscriptionStorageAdapter
+	Push           callbacks.NewEventCallback
+	QueueSize      int
+	OverflowPolicy orchestration.OverflowPolicy
+	mu             sync.Mutex
+	stopped        bool
+	running        map[string]map[string]*run
+	topics         map[string]map[*listener]bool
+}
+
+// NotifyNewSubscription stores the subscription with the Adapter, then starts executing it
+func (e *Engine) NotifyNewSubscription(ctx context.Context, subscriberData subscriptions.Data, queryData subscriptions.Query) error {
+	if err := e.Adapter.NotifyNewSubscription(ctx, subscriberData, queryData); err != nil {
+		return err
+	}
+	e.start(ctx, subscriptions.Request{Data: subscriberData, Query: queryData})
+	return nil
+}
+
+// NotifyNewSubscriptions stores the subscriptions with the Adapter, in one call if it implements NotifyNewSubscriptions,
+// then starts executing the ones it stored
+func (e *Engine) NotifyNewSubscriptions(ctx context.Context, requests []subscriptions.Request) []error {
+	var errs []error
+	if bulkAdapter, ok := e.Adapter.(bulkSubscriptionStorageAdapter); ok {
+		errs = bulkAdapter.NotifyNewSubscriptions(ctx, requests)
+		if len(errs) != len(requests) {
+			return errs
+		}
+	} else {
+		errs = make([]error, len(requests))
+		for i, request := range requests {
+			errs[i] = e.Adapter.NotifyNewSubscription(ctx, request.Data, request.Query)
+		}
+	}
+	for i, request := range requests {
+		if errs[i] == nil {
+			e.start(ctx, request)
+		}
+	}
+	return errs
+}
+
+// NotifyUnsubscribe stops executing the subscription, then removes it from the Adapter
+func (e *Engine) NotifyUnsubscribe(ctx context.Context, subscriberData subscriptions.Data) error {
+	e.Stop(subscriberData.ClientID, subscriberData.SubscriptionID)
+	return e.Adapter.NotifyUnsubscribe(ctx, subscriberData)
+}
+
+// start executes the subscription in its own goroutine, replacing any running with the same IDs.
+// Only the values of ctx are kept, as the request it belongs to ends before the subscription does.
+// Nothing is started once the Engine has been shut down
+func (e *Engine) start(ctx context.Context, request subscriptions.Request) {
+	values := sessions.WithSession(context.Background(), ctx)
+	ctx, cancel := context.WithCancel(subscriptions.WithListener(values, e))
+	data := request.Data
+	started := &run{cancel: cancel, data: data, values: values}
+	ctx = context.WithValue(ctx, runKey, started)
+	e.mu.Lock()
+	if e.stopped {
+		e.mu.Unlock()
+		cancel()
+		return
+	}
+	if e.running == nil {
+		e.running = map[string]map[string]*run{}
+	}
+	client, ok := e.running[data.ClientID]
+	if !ok {
+		client = map[string]*run{}
+		e.running[data.ClientID] = client
+	}
+	if previous, ok := client[data.SubscriptionID]; ok {
+		previous.cancel()
+	}
+	client[data.SubscriptionID] = started
+	e.mu.Unlock()
+
+	results := graphql.Subscribe(graphql.Params{
+		Schema:         *e.Schema,
+		RequestString:  request.Query.RequestString,
+		VariableValues: request.Query.VariableValues,
+		OperationName:  request.Query.OperationName,
+		Context:        ctx,
+	})
+	go e.forward(ctx, data, started, results)
+}
+
+// forward sends the subscription's results to Push until there are no more, then completes it
+// if it wasn't stopped
+func (e *Engine) forward(ctx context.Context, data subscriptions.Data, started *run, results chan *graphql.Result) {
+	defer started.cancel()
+	for result := range results {
+		err := e.Push(subscriptions.WrappedEvent{
+			SubscriptionID: data.SubscriptionID,
+			ClientID:       data.ClientID,
+			QueryResult:    result,
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	// a subscription ended for falling behind is completed like one that ended by itself
+	if (ctx.Err() != nil && atomic.LoadInt32(&started.overflowed) == 0) || !e.forget(data, started) {
+		return
+	}
+	ctx = started.values
+	err := e.Push(subscriptions.WrappedEvent{
+		SubscriptionID: data.SubscriptionID,
+		ClientID:       data.ClientID,
+		Finished:       true,
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+	if err := e.Adapter.NotifyUnsubscribe(ctx, data); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// forget removes the run from the running subscriptions, and returns false if it had already been replaced or stopped
+func (e *Engine) forget(data subscriptions.Data, started *run) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	client := e.running[data.ClientID]
+	if client[data.SubscriptionID] != started {
+		return false
+	}
+	delete(client, data.SubscriptionID)
+	if len(client) == 0 {
+		delete(e.running, data.ClientID)
+	}
+	return true
+}
+
+// Stop stops executing a subscription
+func (e *Engine) Stop(clientID string, subscriptionID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	client := e.running[clientID]
+	if started, ok := client[subscriptionID]; ok {
+		started.cancel()
+		delete(client, subscriptionID)
+	}
+	if len(client) == 0 {
+		delete(e.running, clientID)
+	}
+}
+
+// StopClient stops executing all of a client's subscriptions, when it hasn't reconnected in time,
+// and removes them from the Adapter. A nil *Engine does nothing
+func (e *Engine) StopClient(clientID string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	stopped := make([]*run, 0, len(e.running[clientID]))
+	for _, started := range e.running[clientID] {
+		started.cancel()
+		stopped = append(stopped, started)
+	}
+	delete(e.running, clientID)
+	e.mu.Unlock()
+	for _, started := range stopped {
+		if err := e.Adapter.NotifyUnsubscribe(started.values, started.data); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// Shutdown stops executing every subscription, and starts no more. They are left in the Adapter, as their clients
+// reconnect to another server. A nil *Engine does nothing
+func (e *Engine) Shutdown() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stopped = true
+	for _, client := range e.running {
+		for _, started := range client {
+			started.cancel()
+		}
+	}
+	e.running = nil
+}
+
+// Listen returns the channel the raw events published to the topics are sent down, until ctx is done
+func (e *Engine) Listen(ctx context.Context, topics ...string) chan interface{} {
+	queueSize := e.QueueSize
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	started, _ := ctx.Value(runKey).(*run)
+	l := &listener{events: make(chan interface{}, queueSize), done: ctx.Done(), started: started}
+	e.mu.Lock()
+	if e.topics == nil {
+		e.topics = map[string]map[*listener]bool{}
+	}
+	for _, topic := range topics {
+		if e.topics[topic] == nil {
+			e.topics[topic] = map[*listener]bool{}
+		}
+		e.topics[topic][l] = true
+	}
+	e.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		for _, topic := range topics {
+			delete(e.topics[topic], l)
+			if len(e.topics[topic]) == 0 {
+				delete(e.topics, topic)
+			}
+		}
+	}()
+	return l.events
+}
+
+// Publish queues the event's payload for every subscription listening to its topic, without blocking.
+// A full queue is handled with the OverflowPolicy
+func (e *Engine) Publish(event subscriptions.RawEvent) error {
+	e.mu.Lock()
+	listeners := make([]*listener, 0, len(e.topics[event.Topic]))
+	for l := range e.topics[event.Topic] {
+		listeners = append(listeners, l)
+	}
+	e.mu.Unlock()
+	for _, l := range listeners {
+		e.offer(l, event.Payload)
+	}
+	return nil
+}
+
+// offer queues the payload for the listener, applying the OverflowPolicy if its queue is full.
+// Raw events have no subscription to coalesce by, so CoalesceBySubscription drops the oldest like DropOldest
+func (e *Engine) offer(l *listener, payload interface{}) {
+	select {
+	case l.events <- payload:
+		return
+	case <-l.done:
+		return
+	default:
+	}
+	switch e.OverflowPolicy {
+	case orchestration.DropNewest:
+		return
+	case orchestration.DisconnectSlowConsumer:
+		if l.started != nil {
+			atomic.StoreInt32(&l.started.overflowed, 1)
+			l.started.cancel()
+		}
+		return
+	}
+	// the resolver may take from the queue at the same time, so each step is done without blocking
+	select {
+	case <-l.events:
+	default:
+	}
+	select {
+	case l.events <- payload:
+	default:
+	}
+}
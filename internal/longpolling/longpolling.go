@@ -0,0 +1,187 @@
+package longpolling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/NickBlow/gqlssehandlers/clientid"
+	"github.com/NickBlow/gqlssehandlers/internal/orchestration"
+	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/NickBlow/gqlssehandlers/replay"
+	gonanoid "github.com/matoous/go-nanoid"
+)
+
+// CursorQueryString is the query string the client sends the cursor from its last poll in
+const CursorQueryString = "cursor"
+
+// sessionGracePeriod is how long a session stays connected to the broker after a poll, waiting for the next one
+const sessionGracePeriod = time.Second * 30
+
+// Handler handles the long-polling endpoint, for clients behind proxies that buffer streamed responses.
+// Each poll is held until there are frames for the client or PollTimeout passes, and is answered with
+// the frames and a cursor to send with the next poll.
+// If Protocol is nil, frames are encoded with the protocol named in the request's ProtocolQueryString
+type Handler struct {
+	Broker      *orchestration.Broker
+	Protocol    protocol.Protocol
+	PollTimeout time.Duration
+	mux         sync.Mutex
+	sessions    map[string]*session
+}
+
+// NewHandler creates a Handler with no sessions
+func NewHandler(broker *orchestration.Broker, p protocol.Protocol, pollTimeout time.Duration) *Handler {
+	return &Handler{
+		Broker:      broker,
+		Protocol:    p,
+		PollTimeout: pollTimeout,
+		sessions:    map[string]*session{},
+	}
+}
+
+type pollResponse struct {
+	Cursor   string            `json:"cursor"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+func writeResponse(w http.ResponseWriter, res *protocol.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.StatusCode)
+	w.Write(res.Message)
+}
+
+// getSession returns the client's session, creating and connecting a new one if there isn't one.
+// A new session resumes from the cursor, replaying anything sent since
+func (h *Handler) getSession(clientID string, cursor string) (*session, error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if s, ok := h.sessions[clientID]; ok {
+		return s, nil
+	}
+	connectionID, err := gonanoid.Nanoid()
+	if err != nil {
+		return nil, err
+	}
+	clientInfo := orchestration.ClientInfo{
+		ClientID:        clientID,
+		ConnectionID:    connectionID,
+		Outbox:          h.Broker.NewOutbox(),
+		LastSeenEventID: cursor,
+		CloseChannel:    make(chan bool, 1),
+	}
+	if cursor == "" {
+		// Anything sent after this point will be replayed if the session expires before the next poll
+		cursor = replay.FormatEventID(replay.EventIDAt(time.Now()))
+	}
+	if err := h.Broker.Connect(clientInfo); err != nil {
+		return nil, err
+	}
+	s := newSession(clientInfo, cursor)
+	h.sessions[clientID] = s
+	go h.run(s)
+	return s, nil
+}
+
+// run serves the session's polls one at a time, and disconnects it once the broker closes it or no poll arrives in time
+func (h *Handler) run(s *session) {
+	defer h.end(s)
+	for {
+		select {
+		case poll := <-s.polls:
+			if closed := s.serve(poll, h.PollTimeout); closed {
+				return
+			}
+		case <-s.clientInfo.CloseChannel:
+			return
+		case <-time.After(sessionGracePeriod):
+			return
+		}
+	}
+}
+
+func (h *Handler) end(s *session) {
+	h.mux.Lock()
+	if h.sessions[s.clientInfo.ClientID] == s {
+		delete(h.sessions, s.clientInfo.ClientID)
+	}
+	h.mux.Unlock()
+	close(s.done)
+	h.Broker.Disconnected(s.clientInfo)
+}
+
+// poll sends the poll to the client's session, starting a new one if the last one has just ended
+func (h *Handler) poll(ctx context.Context, clientID string, cursor string) (pollResult, error) {
+	for {
+		s, err := h.getSession(clientID, cursor)
+		if err != nil {
+			return pollResult{}, err
+		}
+		poll := pollRequest{
+			ctx:    ctx,
+			cursor: cursor,
+			result: make(chan pollResult, 1),
+		}
+		select {
+		case s.polls <- poll:
+			return <-poll.result, nil
+		case <-s.done:
+		}
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := h.Protocol
+	if p == nil {
+		p = protocol.ProtocolFromRequest(r)
+	}
+	clientID := clientid.GetClientIDFromRequest(r)
+	if clientID == "" {
+		writeResponse(w, protocol.UnauthorizedResponse(p))
+		return
+	}
+	result, err := h.poll(r.Context(), clientID, r.URL.Query().Get(CursorQueryString))
+	switch err {
+	case nil:
+	case orchestration.ErrConnectionConflict:
+		writeResponse(w, protocol.ConflictResponseFor(p))
+		return
+	case orchestration.ErrShuttingDown:
+		writeResponse(w, protocol.ShuttingDownResponseFor(p))
+		return
+	default:
+		fmt.Println(err)
+		writeResponse(w, protocol.ServerErrorResponseFor(p))
+		return
+	}
+	response := pollResponse{
+		Cursor:   result.cursor,
+		Messages: []json.RawMessage{},
+	}
+	for _, frame := range result.frames {
+		message, err := p.Encode(&protocol.Message{
+			Type:    frame.Type,
+			ID:      frame.SubscriptionID,
+			Payload: frame.Payload,
+			Errors:  frame.Errors,
+		})
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("Could not marshall frame")
+			continue
+		}
+		response.Messages = append(response.Messages, message)
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		fmt.Println(err)
+		writeResponse(w, protocol.ServerErrorResponseFor(p))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(body)
+}
@@ -0,0 +1,91 @@
+package longpolling
+
+import (
+	"context"
+	"time"
+
+	"github.com/NickBlow/gqlssehandlers/internal/orchestration"
+	"github.com/NickBlow/gqlssehandlers/replay"
+)
+
+// pollRequest is sent to a session's goroutine for each poll
+type pollRequest struct {
+	ctx    context.Context
+	cursor string
+	result chan pollResult
+}
+
+// pollResult contains the frames for a poll, and the cursor the client should send with the next one
+type pollResult struct {
+	frames []replay.Frame
+	cursor string
+}
+
+// session keeps a client connected to the broker between polls, so frames are queued in its Outbox rather than
+// only being available for replay. Frames are kept until a poll sends a cursor at or after their id,
+// so a response lost on the way to the client is sent again. It's only ever touched by its own goroutine
+type session struct {
+	clientInfo orchestration.ClientInfo
+	polls      chan pollRequest
+	done       chan struct{}
+	unacked    []replay.Frame
+	cursor     string
+}
+
+func newSession(clientInfo orchestration.ClientInfo, cursor string) *session {
+	return &session{
+		clientInfo: clientInfo,
+		polls:      make(chan pollRequest),
+		done:       make(chan struct{}),
+		cursor:     cursor,
+	}
+}
+
+// acknowledge forgets the frames the client has seen, according to its cursor
+func (s *session) acknowledge(cursor string) {
+	acked := replay.ParseEventID(cursor)
+	var unacked []replay.Frame
+	for _, frame := range s.unacked {
+		if replay.ParseEventID(frame.ID) > acked {
+			unacked = append(unacked, frame)
+		}
+	}
+	s.unacked = unacked
+}
+
+// serve answers a poll with the unacknowledged frames, or waits for new ones until the poll times out.
+// It returns true if the broker closed the session
+func (s *session) serve(poll pollRequest, pollTimeout time.Duration) bool {
+	if poll.cursor != "" {
+		s.acknowledge(poll.cursor)
+	}
+	frames := s.unacked
+	closed := false
+	timeout := time.NewTimer(pollTimeout)
+	defer timeout.Stop()
+Wait:
+	for len(frames) == 0 {
+		select {
+		case <-s.clientInfo.Outbox.Ready():
+			frames = s.clientInfo.Outbox.Drain()
+		case <-s.clientInfo.CloseChannel:
+			frames = s.clientInfo.Outbox.Drain()
+			closed = true
+			break Wait
+		case <-poll.ctx.Done():
+			break Wait
+		case <-timeout.C:
+			break Wait
+		}
+	}
+	var unacked []replay.Frame
+	for _, frame := range frames {
+		if frame.ID != "" {
+			unacked = append(unacked, frame)
+			s.cursor = frame.ID
+		}
+	}
+	s.unacked = unacked
+	poll.result <- pollResult{frames: frames, cursor: s.cursor}
+	return closed
+}
@@ -0,0 +1,132 @@
+package orchestration
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NickBlow/gqlssehandlers/replay"
+	"github.com/NickBlow/gqlssehandlers/subscriptions"
+)
+
+const benchmarkClients = 1000
+
+// benchmarkShards is the number of shards the sharded benchmarks use, run them with -cpu to vary the parallelism
+const benchmarkShards = 16
+
+// benchmarkEvent is the query result pushed in the benchmarks, carrying the time it was pushed
+type benchmarkEvent struct {
+	PushedAt int64 `json:"pushedAt"`
+}
+
+// benchmarkBroker starts a broker with the given number of shards, and connects benchmarkClients streams to it.
+// Each stream drains its Outbox as soon as it is ready, recording the latency of every frame it receives.
+// The returned function closes the streams and returns the latencies
+func benchmarkBroker(b *testing.B, shards int) (*Broker, []string, func() []time.Duration) {
+	broker := InitializeBroker(nil, func(string) error { return nil }, func(string) error { return nil }, Options{
+		ReplayStore:        replay.NewMemoryStore(16, time.Minute),
+		ReplayTrimInterval: time.Minute,
+		OutboundQueueSize:  1024,
+		OverflowPolicy:     DropOldest,
+		Shards:             shards,
+	})
+	clientIDs := make([]string, benchmarkClients)
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var streams sync.WaitGroup
+	for i := range clientIDs {
+		clientIDs[i] = fmt.Sprintf("client-%d", i)
+		client := ClientInfo{
+			ClientID:     clientIDs[i],
+			ConnectionID: clientIDs[i],
+			Outbox:       broker.NewOutbox(),
+			CloseChannel: make(chan bool, 1),
+		}
+		if err := broker.Connect(client); err != nil {
+			b.Fatal(err)
+		}
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			for {
+				select {
+				case <-client.CloseChannel:
+					broker.Disconnected(client)
+					return
+				case <-client.Outbox.Ready():
+					received := time.Now()
+					var frameLatencies []time.Duration
+					for _, frame := range client.Outbox.Drain() {
+						var event benchmarkEvent
+						if err := json.Unmarshal(frame.Payload, &event); err != nil || event.PushedAt == 0 {
+							continue
+						}
+						frameLatencies = append(frameLatencies, received.Sub(time.Unix(0, event.PushedAt)))
+					}
+					mu.Lock()
+					latencies = append(latencies, frameLatencies...)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	stop := func() []time.Duration {
+		for _, clientID := range clientIDs {
+			broker.CloseClient(clientID)
+		}
+		streams.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		return latencies
+	}
+	return broker, clientIDs, stop
+}
+
+// benchmarkPush pushes b.N events spread across all the clients from several goroutines,
+// and reports the p99 latency from PushDataToClient to the stream's Outbox being ready
+func benchmarkPush(b *testing.B, shards int) {
+	broker, clientIDs, stop := benchmarkBroker(b, shards)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var next uint64
+	var nextMu sync.Mutex
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			nextMu.Lock()
+			clientID := clientIDs[next%uint64(len(clientIDs))]
+			next++
+			nextMu.Unlock()
+			err := broker.PushDataToClient(subscriptions.WrappedEvent{
+				SubscriptionID: "subscription",
+				ClientID:       clientID,
+				QueryResult:    benchmarkEvent{PushedAt: time.Now().UnixNano()},
+			})
+			if err != nil {
+				// FailNow can't be called off the benchmark goroutine
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	latencies := stop()
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p99 := latencies[len(latencies)*99/100]
+	b.ReportMetric(float64(p99.Microseconds()), "p99-µs")
+}
+
+// BenchmarkPushDataToClientSingleShard has every client handled by the same shard goroutine
+func BenchmarkPushDataToClientSingleShard(b *testing.B) {
+	benchmarkPush(b, 1)
+}
+
+// BenchmarkPushDataToClientSharded partitions the same clients across benchmarkShards shards
+func BenchmarkPushDataToClientSharded(b *testing.B) {
+	benchmarkPush(b, benchmarkShards)
+}
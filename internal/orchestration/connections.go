@@ -0,0 +1,71 @@
+package orchestration
+
+import (
+	"errors"
+
+	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/NickBlow/gqlssehandlers/replay"
+)
+
+// ConnectionPolicy decides what happens when a client opens a stream while it already has one open
+type ConnectionPolicy int
+
+const (
+	// FanOut keeps every stream open and sends each frame to all of them
+	FanOut ConnectionPolicy = iota
+	// KeepNewest sends the older streams a MessageConnectionTerminate frame and closes them
+	KeepNewest
+	// RejectNewest refuses the new stream, leaving the existing one open
+	RejectNewest
+)
+
+// ErrConnectionConflict is returned by Broker.Connect when a stream is rejected by the RejectNewest policy
+var ErrConnectionConflict = errors.New("Client already has an open stream")
+
+// addConnection registers a new stream for the client, applying the connection policy.
+// It returns true if this is the first stream for that client.
+func (s *shard) addConnection(client ClientInfo) (bool, error) {
+	connections, ok := s.clients[client.ClientID]
+	if !ok {
+		s.clients[client.ClientID] = map[string]ClientInfo{client.ConnectionID: client}
+		return true, nil
+	}
+	switch s.broker.connectionPolicy {
+	case RejectNewest:
+		return false, ErrConnectionConflict
+	case KeepNewest:
+		for connectionID, existing := range connections {
+			existing.Outbox.force(replay.Frame{Type: protocol.MessageConnectionTerminate})
+			closeConnection(existing)
+			delete(connections, connectionID)
+		}
+	}
+	connections[client.ConnectionID] = client
+	return false, nil
+}
+
+// removeConnection unregisters a closed stream. It returns true if that was the client's last stream.
+func (s *shard) removeConnection(client ClientInfo) bool {
+	connections, ok := s.clients[client.ClientID]
+	if !ok {
+		return false
+	}
+	if _, ok := connections[client.ConnectionID]; !ok {
+		// Already removed, e.g. replaced by a newer stream under the KeepNewest policy
+		return false
+	}
+	delete(connections, client.ConnectionID)
+	if len(connections) > 0 {
+		return false
+	}
+	delete(s.clients, client.ClientID)
+	return true
+}
+
+// closeConnection asks a stream to stop. CloseChannel is buffered, so if a close is already pending there is nothing to do
+func closeConnection(client ClientInfo) {
+	select {
+	case client.CloseChannel <- true:
+	default:
+	}
+}
@@ -1,87 +1,215 @@
 package orchestration
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/NickBlow/gqlssehandlers/replay"
 	"github.com/NickBlow/gqlssehandlers/subscriptions"
 	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
 )
 
-// ClientInfo contains information about a connected client
+// ClientInfo contains information about a single stream opened by a client.
+// A client can have several streams open at once, each with its own ConnectionID.
+// CloseChannel should be buffered so the broker never blocks on it.
+// Outbox should be created with Broker.NewOutbox.
 type ClientInfo struct {
-	ClientID             string
-	CommunicationChannel chan []byte
-	LastSeenEventID      string
-	CloseChannel         chan bool
+	ClientID        string
+	ConnectionID    string
+	Outbox          *Outbox
+	LastSeenEventID string
+	CloseChannel    chan bool
+	registered      chan error
+}
+
+// Options contains the tunable settings of the Broker
+type Options struct {
+	// ReplayStore keeps the frames sent to each client, so they can be replayed on reconnect
+	ReplayStore replay.Store
+	// ReplayTrimInterval is how often ReplayStore.Trim is called
+	ReplayTrimInterval time.Duration
+	// ConnectionPolicy decides what happens when a client opens more than one stream
+	ConnectionPolicy ConnectionPolicy
+	// OutboundQueueSize is the number of frames that can be waiting to be written to a stream
+	OutboundQueueSize int
+	// OverflowPolicy decides what happens when a stream's outbound queue is full
+	OverflowPolicy OverflowPolicy
+	// Shards is the number of partitions client state is split across, each with its own goroutine
+	Shards int
+	// ShutdownRetry is the reconnect delay sent to clients when their stream is closed by Shutdown
+	ShutdownRetry time.Duration
+}
+
+// ErrShuttingDown is returned by Broker.Connect once Shutdown has been called
+var ErrShuttingDown = errors.New("Server is shutting down")
+
+// DeliveryStats counts the frames that were not delivered as sent because a stream could not keep up
+type DeliveryStats struct {
+	DroppedFrames           uint64
+	CoalescedFrames         uint64
+	SlowConsumerDisconnects uint64
 }
 
 // Broker contains all the details to manage state of connected clients.
+// Clients are partitioned across shards by a hash of their client ID,
+// so connects, disconnects and events for different clients are handled concurrently.
 type Broker struct {
-	NewClients     chan ClientInfo
-	ClosedClients  chan string
-	ClosingClients chan string
-	Schema         *graphql.Schema
-	newEvents      chan subscriptions.WrappedEvent
-	bufferedEvents []interface{} // TODO implement
-	clients        map[string]ClientInfo
+	Schema           *graphql.Schema
+	shards           []*shard
+	bufferedEvents   replay.Store
+	connectionPolicy ConnectionPolicy
+	outboundSize     int
+	overflowPolicy   OverflowPolicy
+	shutdownRetry    time.Duration
+	stopping         chan struct{}
+	stopOnce         sync.Once
+	droppedFrames    uint64
+	coalescedFrames  uint64
+	slowDisconnects  uint64
 }
 
 // InitializeBroker creates a broker and starts listening to events
-func InitializeBroker(schema *graphql.Schema, newClientCb func(string) error, clientDisconnectCb func(string) error) *Broker {
+func InitializeBroker(schema *graphql.Schema, newClientCb func(string) error, clientDisconnectCb func(string) error, options Options) *Broker {
+	shardCount := options.Shards
+	if shardCount < 1 {
+		shardCount = 1
+	}
 	b := &Broker{
-		Schema:         schema,
-		NewClients:     make(chan ClientInfo),
-		ClosedClients:  make(chan string),
-		ClosingClients: make(chan string),
-		newEvents:      make(chan subscriptions.WrappedEvent),
-		bufferedEvents: make([]interface{}, 0),
-		clients:        map[string]ClientInfo{},
+		Schema:           schema,
+		shards:           make([]*shard, shardCount),
+		bufferedEvents:   options.ReplayStore,
+		connectionPolicy: options.ConnectionPolicy,
+		outboundSize:     options.OutboundQueueSize,
+		overflowPolicy:   options.OverflowPolicy,
+		shutdownRetry:    options.ShutdownRetry,
+		stopping:         make(chan struct{}),
+	}
+	for i := range b.shards {
+		b.shards[i] = newShard(b, newClientCb, clientDisconnectCb)
+		go b.shards[i].listen()
 	}
-	go b.listen(newClientCb, clientDisconnectCb)
+	go b.trimReplayStore(options.ReplayTrimInterval)
 	return b
 }
 
+// shardFor returns the shard that owns the client's state
+func (b *Broker) shardFor(clientID string) *shard {
+	hash := fnv.New32a()
+	hash.Write([]byte(clientID))
+	return b.shards[hash.Sum32()%uint32(len(b.shards))]
+}
+
 // PushDataToClient sends the event payload to the specified clients
 func (b *Broker) PushDataToClient(event subscriptions.WrappedEvent) error {
-	b.newEvents <- event
+	s := b.shardFor(event.ClientID)
+	select {
+	case s.newEvents <- event:
+		return nil
+	case <-s.done:
+		return ErrShuttingDown
+	}
+}
+
+// revocation is an error frame ending one of a client's subscriptions
+type revocation struct {
+	clientID       string
+	subscriptionID string
+	errors         []gqlerrors.FormattedError
+}
+
+// RevokeSubscription sends the client a MessageError frame for the subscription, which tells it the subscription
+// has ended. Like results, the frame is kept for replay
+func (b *Broker) RevokeSubscription(clientID string, subscriptionID string, errs []gqlerrors.FormattedError) error {
+	s := b.shardFor(clientID)
+	select {
+	case s.revocations <- revocation{clientID: clientID, subscriptionID: subscriptionID, errors: errs}:
+		return nil
+	case <-s.done:
+		return ErrShuttingDown
+	}
+}
+
+// Connect registers a new stream, replaying any missed frames into its Outbox.
+// It returns ErrConnectionConflict if the stream was rejected by the connection policy,
+// and ErrShuttingDown once Shutdown has been called
+func (b *Broker) Connect(client ClientInfo) error {
+	client.registered = make(chan error, 1)
+	s := b.shardFor(client.ClientID)
+	select {
+	case s.newClients <- client:
+		return <-client.registered
+	case <-s.done:
+		return ErrShuttingDown
+	}
+}
+
+// Disconnected unregisters a stream once it has stopped
+func (b *Broker) Disconnected(client ClientInfo) {
+	s := b.shardFor(client.ClientID)
+	select {
+	case s.closedClients <- client:
+	case <-s.done:
+	}
+}
+
+// CloseClient closes all of the client's streams
+func (b *Broker) CloseClient(clientID string) {
+	s := b.shardFor(clientID)
+	select {
+	case s.closingClients <- clientID:
+	case <-s.done:
+	}
+}
+
+// Shutdown stops accepting new streams and closes every open one, after queueing a MessageServerShutdown frame
+// with a retry hint so clients reconnect elsewhere. It waits until every stream has drained its queued frames and stopped,
+// calling the disconnect callback for each client, or until the context is done
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.stopOnce.Do(func() {
+		close(b.stopping)
+	})
+	for _, s := range b.shards {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 	return nil
 }
 
-func (b *Broker) listen(newClientCb func(string) error, clientDisconnectCb func(string) error) {
+// NewOutbox creates the outbound queue for a new stream, using the broker's queue size and overflow policy
+func (b *Broker) NewOutbox() *Outbox {
+	return newOutbox(b.outboundSize, b.overflowPolicy)
+}
+
+// Stats returns the delivery counters since the broker started. It is safe to call from any goroutine
+func (b *Broker) Stats() DeliveryStats {
+	return DeliveryStats{
+		DroppedFrames:           atomic.LoadUint64(&b.droppedFrames),
+		CoalescedFrames:         atomic.LoadUint64(&b.coalescedFrames),
+		SlowConsumerDisconnects: atomic.LoadUint64(&b.slowDisconnects),
+	}
+}
+
+func (b *Broker) trimReplayStore(interval time.Duration) {
+	trimTicker := time.NewTicker(interval)
+	defer trimTicker.Stop()
 	for {
 		select {
-		case client := <-b.NewClients:
-			b.clients[client.ClientID] = client
-			newClientCb(client.ClientID)
-		case client := <-b.ClosingClients:
-			b.clients[client].CloseChannel <- true
-		case client := <-b.ClosedClients:
-			delete(b.clients, client)
-			clientDisconnectCb(client)
-		case event := <-b.newEvents:
-			client := b.clients[event.ClientID]
-			if client.CommunicationChannel == nil {
-				break
-			}
-			resultType := protocol.GQLData
-			if event.Finished {
-				resultType = protocol.GQLComplete
-			}
-			data, err := json.Marshal(
-				&protocol.GQLOverWebsocketProtocol{
-					Type:    resultType,
-					Payload: &protocol.PayloadBytes{Value: event.QueryResult},
-					ID:      event.SubscriptionID,
-				},
-			)
-			if err != nil {
+		case <-b.stopping:
+			return
+		case now := <-trimTicker.C:
+			if err := b.bufferedEvents.Trim(now); err != nil {
 				fmt.Println(err)
-				fmt.Println("Could not marshall data")
-			} else {
-				client.CommunicationChannel <- data
+				fmt.Println("Could not trim replay store")
 			}
 		}
 	}
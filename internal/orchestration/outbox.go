@@ -0,0 +1,123 @@
+package orchestration
+
+import (
+	"sync"
+
+	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/NickBlow/gqlssehandlers/replay"
+)
+
+// OverflowPolicy decides what happens when a frame is sent to a stream whose outbound queue is full
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued frame to make room for the new one
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the new frame, keeping the ones already queued
+	DropNewest
+	// CoalesceBySubscription replaces a queued MessageData frame for the same subscription with the new one,
+	// so only the latest result is kept. If there is nothing to coalesce the oldest frame is dropped
+	CoalesceBySubscription
+	// DisconnectSlowConsumer sends a MessageConnectionError frame and closes the stream
+	DisconnectSlowConsumer
+)
+
+type offerResult int
+
+const (
+	offerQueued offerResult = iota
+	offerDropped
+	offerCoalesced
+	offerOverflowed
+)
+
+// Outbox is the bounded queue of frames waiting to be written to a single stream.
+// The broker adds frames without blocking, and the stream writes them out whenever Ready fires.
+type Outbox struct {
+	mu     sync.Mutex
+	frames []replay.Frame
+	size   int
+	policy OverflowPolicy
+	ready  chan struct{}
+}
+
+func newOutbox(size int, policy OverflowPolicy) *Outbox {
+	return &Outbox{
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// Ready receives a value whenever frames have been queued since the last Drain
+func (o *Outbox) Ready() <-chan struct{} {
+	return o.ready
+}
+
+// Drain removes and returns all the queued frames
+func (o *Outbox) Drain() []replay.Frame {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	frames := o.frames
+	o.frames = nil
+	return frames
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// offer queues the frame, applying the overflow policy if the queue is full
+func (o *Outbox) offer(frame replay.Frame) offerResult {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	result := offerQueued
+	if len(o.frames) >= o.size {
+		switch o.policy {
+		case DropNewest:
+			return offerDropped
+		case DisconnectSlowConsumer:
+			return offerOverflowed
+		case CoalesceBySubscription:
+			if o.removeQueuedData(frame) {
+				result = offerCoalesced
+				break
+			}
+			o.frames = o.frames[1:]
+			result = offerDropped
+		default:
+			o.frames = o.frames[1:]
+			result = offerDropped
+		}
+	}
+	o.frames = append(o.frames, frame)
+	o.notify()
+	return result
+}
+
+// removeQueuedData removes the queued MessageData frame for the same subscription as frame, if there is one.
+// The new frame is appended rather than put in its place, so event ids are still written in order
+func (o *Outbox) removeQueuedData(frame replay.Frame) bool {
+	if frame.Type != protocol.MessageData {
+		return false
+	}
+	for i, queued := range o.frames {
+		if queued.Type == protocol.MessageData && queued.SubscriptionID == frame.SubscriptionID {
+			o.frames = append(o.frames[:i], o.frames[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// force queues the frame regardless of the queue size. It's used for control frames and replays,
+// which must not be dropped
+func (o *Outbox) force(frames ...replay.Frame) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.frames = append(o.frames, frames...)
+	o.notify()
+}
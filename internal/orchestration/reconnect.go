@@ -0,0 +1,49 @@
+package orchestration
+
+import (
+	"sync"
+	"time"
+)
+
+// ReconnectWindow calls Expire for each client that hasn't opened a stream within Timeout of its last stream closing,
+// so the state kept for a client outlives a reconnect, but not a client that has gone away
+type ReconnectWindow struct {
+	Timeout time.Duration
+	Expire  func(clientID string)
+	mu      sync.Mutex
+	timers  map[string]*time.Timer
+}
+
+// Connected cancels the expiry of a client that has opened a stream again
+func (w *ReconnectWindow) Connected(clientID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if timer, ok := w.timers[clientID]; ok {
+		timer.Stop()
+		delete(w.timers, clientID)
+	}
+}
+
+// Disconnected starts the window for a client whose last stream has closed
+func (w *ReconnectWindow) Disconnected(clientID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timers == nil {
+		w.timers = map[string]*time.Timer{}
+	}
+	if timer, ok := w.timers[clientID]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(w.Timeout, func() {
+		w.mu.Lock()
+		if w.timers[clientID] != timer {
+			w.mu.Unlock()
+			return
+		}
+		delete(w.timers, clientID)
+		w.mu.Unlock()
+		w.Expire(clientID)
+	})
+	w.timers[clientID] = timer
+}
@@ -0,0 +1,185 @@
+package orchestration
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/NickBlow/gqlssehandlers/replay"
+	"github.com/NickBlow/gqlssehandlers/subscriptions"
+)
+
+// shard owns the state of a subset of the broker's clients, and is only ever touched by its own goroutine.
+// Once the broker starts stopping, the shard closes all its streams and exits when the last one has stopped,
+// closing done.
+type shard struct {
+	done               chan struct{}
+	stopping           bool
+	broker             *Broker
+	newClients         chan ClientInfo
+	closedClients      chan ClientInfo
+	closingClients     chan string
+	newEvents          chan subscriptions.WrappedEvent
+	revocations        chan revocation
+	clients            map[string]map[string]ClientInfo
+	lastEventID        uint64
+	newClientCb        func(string) error
+	clientDisconnectCb func(string) error
+}
+
+func newShard(b *Broker, newClientCb func(string) error, clientDisconnectCb func(string) error) *shard {
+	return &shard{
+		done:               make(chan struct{}),
+		broker:             b,
+		newClients:         make(chan ClientInfo),
+		closedClients:      make(chan ClientInfo),
+		closingClients:     make(chan string),
+		newEvents:          make(chan subscriptions.WrappedEvent),
+		revocations:        make(chan revocation),
+		clients:            map[string]map[string]ClientInfo{},
+		newClientCb:        newClientCb,
+		clientDisconnectCb: clientDisconnectCb,
+	}
+}
+
+// nextEventID returns a strictly increasing id based on the clock,
+// so that ids issued after a restart are still greater than the ones issued before it.
+// A client always belongs to the same shard, so its ids are increasing too
+func (s *shard) nextEventID(now time.Time) uint64 {
+	id := replay.EventIDAt(now)
+	if id <= s.lastEventID {
+		id = s.lastEventID + 1
+	}
+	s.lastEventID = id
+	return id
+}
+
+func (s *shard) replayMissedFrames(client ClientInfo) {
+	frames, missed, err := s.broker.bufferedEvents.ReadAfter(client.ClientID, client.LastSeenEventID)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("Could not read frames for replay")
+		missed = true
+	}
+	if missed {
+		payload, _ := json.Marshal(map[string]string{"lastEventId": client.LastSeenEventID})
+		client.Outbox.force(replay.Frame{
+			Type:    protocol.MessageEventsMissed,
+			Payload: payload,
+		})
+	}
+	client.Outbox.force(frames...)
+}
+
+// publish gives the frame the next event id, stores it for replay and delivers it to the client's streams
+func (s *shard) publish(clientID string, frame replay.Frame) {
+	frame.ID = replay.FormatEventID(s.nextEventID(time.Now()))
+	if err := s.broker.bufferedEvents.Append(clientID, frame); err != nil {
+		fmt.Println(err)
+		fmt.Println("Could not store frame for replay")
+	}
+	if s.deliver(clientID, frame) {
+		s.clientDisconnectCb(clientID)
+	}
+}
+
+// deliver queues the frame on every stream the client has open, without blocking.
+// Streams that overflow under the DisconnectSlowConsumer policy are closed and removed,
+// and it returns true if that removed the client's last stream
+func (s *shard) deliver(clientID string, frame replay.Frame) bool {
+	lastRemoved := false
+	for _, connection := range s.clients[clientID] {
+		switch connection.Outbox.offer(frame) {
+		case offerDropped:
+			atomic.AddUint64(&s.broker.droppedFrames, 1)
+		case offerCoalesced:
+			atomic.AddUint64(&s.broker.coalescedFrames, 1)
+		case offerOverflowed:
+			atomic.AddUint64(&s.broker.slowDisconnects, 1)
+			connection.Outbox.force(replay.Frame{
+				Type:    protocol.MessageConnectionError,
+				Payload: json.RawMessage(`{"message":"Client could not keep up with the events sent to it"}`),
+			})
+			closeConnection(connection)
+			lastRemoved = s.removeConnection(connection)
+		}
+	}
+	return lastRemoved
+}
+
+// stop queues the shutdown frame on every open stream and closes it
+func (s *shard) stop() {
+	s.stopping = true
+	for _, connections := range s.clients {
+		for _, connection := range connections {
+			connection.Outbox.force(replay.Frame{
+				Type:  protocol.MessageServerShutdown,
+				Retry: s.broker.shutdownRetry,
+			})
+			closeConnection(connection)
+		}
+	}
+}
+
+func (s *shard) listen() {
+	defer close(s.done)
+	brokerStopping := s.broker.stopping
+	for {
+		if s.stopping && len(s.clients) == 0 {
+			return
+		}
+		select {
+		case <-brokerStopping:
+			brokerStopping = nil
+			s.stop()
+		case client := <-s.newClients:
+			if s.stopping {
+				client.registered <- ErrShuttingDown
+				break
+			}
+			isFirstConnection, err := s.addConnection(client)
+			client.registered <- err
+			if err != nil {
+				break
+			}
+			if isFirstConnection {
+				s.newClientCb(client.ClientID)
+			}
+			if client.LastSeenEventID != "" {
+				s.replayMissedFrames(client)
+			}
+		case clientID := <-s.closingClients:
+			for _, connection := range s.clients[clientID] {
+				closeConnection(connection)
+			}
+		case client := <-s.closedClients:
+			if s.removeConnection(client) {
+				s.clientDisconnectCb(client.ClientID)
+			}
+		case event := <-s.newEvents:
+			payload, err := json.Marshal(event.QueryResult)
+			if err != nil {
+				fmt.Println(err)
+				fmt.Println("Could not marshall data")
+				break
+			}
+			resultType := protocol.MessageData
+			if event.Finished {
+				resultType = protocol.MessageComplete
+			}
+			s.publish(event.ClientID, replay.Frame{
+				Type:           resultType,
+				SubscriptionID: event.SubscriptionID,
+				Payload:        payload,
+			})
+		case revoked := <-s.revocations:
+			s.publish(revoked.clientID, replay.Frame{
+				Type:           protocol.MessageError,
+				SubscriptionID: revoked.subscriptionID,
+				Errors:         revoked.errors,
+			})
+		}
+	}
+}
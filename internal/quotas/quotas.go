@@ -0,0 +1,136 @@
+// Package quotas counts the active subscriptions of each client and user, refusing starts over the limits
+package quotas
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// QuotaExceeded is the error code set in the extensions of the error returned when a quota is full
+const QuotaExceeded = "SUBSCRIPTION_QUOTA_EXCEEDED"
+
+// activeSubscription is the user a subscription was counted against, empty if it wasn't
+type activeSubscription struct {
+	user string
+}
+
+// Quotas counts the active subscriptions of each client, and of each user if UserFromContext is set.
+// A zero maximum means that quota isn't enforced. A nil *Quotas enforces nothing.
+type Quotas struct {
+	MaxPerClient    int
+	MaxPerUser      int
+	UserFromContext func(ctx context.Context) string
+	mu              sync.Mutex
+	clients         map[string]map[string]activeSubscription
+	users           map[string]int
+}
+
+type quotaError struct {
+	quota string
+	limit int
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("Too many active subscriptions for this %v, the maximum is %d", e.quota, e.limit)
+}
+
+// Acquire counts a new subscription, or returns the response refusing it, encoded with p, if it would go over a quota.
+// It returns true if it counted the subscription, so it should be released if the subscription can't be stored.
+// Starting a subscription that is already active doesn't count it again
+func (q *Quotas) Acquire(ctx context.Context, p protocol.Protocol, clientID string, subscriptionID string) (bool, *protocol.Response) {
+	reserved, err := q.acquire(ctx, clientID, subscriptionID)
+	if err != nil {
+		return false, exceededResponse(p, err)
+	}
+	return reserved, nil
+}
+
+func (q *Quotas) acquire(ctx context.Context, clientID string, subscriptionID string) (bool, *quotaError) {
+	if q == nil {
+		return false, nil
+	}
+	user := ""
+	if q.UserFromContext != nil {
+		user = q.UserFromContext(ctx)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.clients == nil {
+		q.clients = map[string]map[string]activeSubscription{}
+		q.users = map[string]int{}
+	}
+	active := q.clients[clientID]
+	if _, ok := active[subscriptionID]; ok {
+		return false, nil
+	}
+	if q.MaxPerClient > 0 && len(active) >= q.MaxPerClient {
+		return false, &quotaError{quota: "client", limit: q.MaxPerClient}
+	}
+	if user != "" && q.MaxPerUser > 0 && q.users[user] >= q.MaxPerUser {
+		return false, &quotaError{quota: "user", limit: q.MaxPerUser}
+	}
+	if active == nil {
+		active = map[string]activeSubscription{}
+		q.clients[clientID] = active
+	}
+	active[subscriptionID] = activeSubscription{user: user}
+	if user != "" {
+		q.users[user]++
+	}
+	return true, nil
+}
+
+func (q *Quotas) releaseLocked(clientID string, subscriptionID string) {
+	subscription, ok := q.clients[clientID][subscriptionID]
+	if !ok {
+		return
+	}
+	delete(q.clients[clientID], subscriptionID)
+	if len(q.clients[clientID]) == 0 {
+		delete(q.clients, clientID)
+	}
+	if subscription.user == "" {
+		return
+	}
+	q.users[subscription.user]--
+	if q.users[subscription.user] <= 0 {
+		delete(q.users, subscription.user)
+	}
+}
+
+// Release stops counting a subscription, when it is stopped or completed
+func (q *Quotas) Release(clientID string, subscriptionID string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked(clientID, subscriptionID)
+}
+
+// ReleaseClient stops counting all of a client's subscriptions, when it hasn't reconnected in time
+func (q *Quotas) ReleaseClient(clientID string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for subscriptionID := range q.clients[clientID] {
+		q.releaseLocked(clientID, subscriptionID)
+	}
+}
+
+func exceededResponse(p protocol.Protocol, err *quotaError) *protocol.Response {
+	formatted := gqlerrors.NewFormattedError(err.Error())
+	formatted.Extensions = map[string]interface{}{
+		"code":  QuotaExceeded,
+		"quota": err.quota,
+		"limit": err.limit,
+	}
+	return protocol.ErrorResponse(p, http.StatusTooManyRequests, formatted)
+}
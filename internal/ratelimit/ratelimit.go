@@ -0,0 +1,121 @@
+// Package ratelimit is a token bucket rate limiter keyed by an arbitrary string, such as a client ID
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/NickBlow/gqlssehandlers/clientid"
+)
+
+// Rate is the number of requests allowed per second, with bursts of up to Burst requests.
+// If Burst is less than 1 it is treated as 1. A zero PerSecond means no limit
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// sweepInterval is how often buckets that have filled back up are forgotten
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Limiter keeps a bucket of tokens per key, refilled at the Rate. A nil *Limiter allows everything
+type Limiter struct {
+	rate      Rate
+	burst     float64
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// New creates a Limiter, or returns nil if the rate has no limit
+func New(rate Rate) *Limiter {
+	if rate.PerSecond <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:      rate,
+		burst:     math.Max(float64(rate.Burst), 1),
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// refill adds the tokens earned since the bucket was last updated
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate.PerSecond)
+	b.updated = now
+}
+
+// sweep forgets the buckets that are full, as they are the same as a new bucket
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Allow takes a token from the key's bucket. If the bucket is empty it returns false,
+// along with how long it will be until a token is available
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate.PerSecond * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// KeyFunc returns the key a request is rate limited by
+type KeyFunc func(r *http.Request) string
+
+// Key returns the key for the request from keyFunc, or the request's client ID if keyFunc is nil
+func Key(r *http.Request, keyFunc KeyFunc) string {
+	if keyFunc == nil {
+		return clientid.GetClientIDFromRequest(r)
+	}
+	return keyFunc(r)
+}
+
+// RemoteIP returns the IP address the request came from
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// KeyOrRemoteIP returns the key for the request from keyFunc, or the request's IP address if keyFunc is nil,
+// for requests made before they have a client ID
+func KeyOrRemoteIP(r *http.Request, keyFunc KeyFunc) string {
+	if keyFunc == nil {
+		return RemoteIP(r)
+	}
+	return keyFunc(r)
+}
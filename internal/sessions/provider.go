@@ -0,0 +1,56 @@
+package sessions
+
+import (
+	"net/http"
+
+	"github.com/NickBlow/gqlssehandlers/clientid"
+)
+
+// Provider wraps the client ID provider when clients have sessions. The session of a request is attached before its
+// client ID is resolved, so a clientid.Signer checks the ID against the user of the session. Client IDs without a
+// session are ignored, and new IDs are only issued in answer to GQL_INIT, after the connect hook has run
+type Provider struct {
+	clientid.Provider
+	// Unverified reads the client ID a request sends, without checking it
+	Unverified clientid.Provider
+	// BindsUsers is set if the wrapped Provider only accepts client IDs from the user they were issued to
+	BindsUsers bool
+	Store      *Store
+}
+
+// Resolve returns the client ID resolved by the wrapped Provider with the client's session attached to the request,
+// or with the session already attached to it
+func (p *Provider) Resolve(r *http.Request) (string, error) {
+	if !Attached(r.Context()) {
+		clientID, err := p.Unverified.Resolve(r)
+		if err != nil || clientID == "" {
+			return clientID, err
+		}
+		withSession, ok := p.Store.Attach(r, clientID)
+		if !ok {
+			return "", nil
+		}
+		r = withSession
+	}
+	return p.Provider.Resolve(r)
+}
+
+// Reclaim returns the client ID sent with a connection init message from a client without a session, with the values
+// of its new session attached to the request. It returns true if the client can keep the ID, which it can only when
+// the wrapped Provider binds IDs to users and the ID was issued to the session's user. Otherwise the ID is only
+// returned if the wrapped Provider accepts it, so its subscriptions can be ended, and is empty if it doesn't
+func (p *Provider) Reclaim(r *http.Request) (string, bool) {
+	presented, err := p.Unverified.Resolve(r)
+	if err != nil || presented == "" {
+		return "", false
+	}
+	if _, err := p.Provider.Resolve(r); err != nil {
+		return "", false
+	}
+	return presented, p.BindsUsers
+}
+
+// IssuesOnlyOnInit is always true, as sessions are only started by GQL_INIT
+func (p *Provider) IssuesOnlyOnInit() bool {
+	return true
+}
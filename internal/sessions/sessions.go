@@ -0,0 +1,142 @@
+// Package sessions keeps the context returned by the connect hook for each client,
+// so its values are available to every later request from that client
+package sessions
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/NickBlow/gqlssehandlers/clientid"
+	"github.com/NickBlow/gqlssehandlers/credentials"
+	"github.com/NickBlow/gqlssehandlers/protocol"
+)
+
+type session struct {
+	values   context.Context
+	lastUsed time.Time
+}
+
+// Store keeps a session per client ID. Sessions that haven't been used for the idle timeout, or whose credentials
+// have expired, are forgotten, and the client has to send a connection init message again
+type Store struct {
+	idleTimeout time.Duration
+	mu          sync.Mutex
+	sessions    map[string]*session
+	lastSweep   time.Time
+}
+
+// NewStore creates a Store forgetting sessions that have been idle for idleTimeout
+func NewStore(idleTimeout time.Duration) *Store {
+	return &Store{
+		idleTimeout: idleTimeout,
+		sessions:    map[string]*session{},
+		lastSweep:   time.Now(),
+	}
+}
+
+// Set starts a session for the client, replacing any it already had. Only the values of ctx are used
+func (s *Store) Set(clientID string, ctx context.Context) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) > s.idleTimeout {
+		for id, existing := range s.sessions {
+			if now.Sub(existing.lastUsed) > s.idleTimeout {
+				delete(s.sessions, id)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.sessions[clientID] = &session{values: ctx, lastUsed: now}
+}
+
+// Get returns the values of the client's session, and whether it has one
+func (s *Store) Get(clientID string) (context.Context, bool) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.sessions[clientID]
+	if !ok || now.Sub(existing.lastUsed) > s.idleTimeout || credentials.Expired(existing.values, now) {
+		delete(s.sessions, clientID)
+		return nil, false
+	}
+	existing.lastUsed = now
+	return existing.values, true
+}
+
+// Delete ends the client's session
+func (s *Store) Delete(clientID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, clientID)
+}
+
+// valuesContext is a request context that also has the values of a session
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesContext) Value(key interface{}) interface{} {
+	if value := c.values.Value(key); value != nil {
+		return value
+	}
+	return c.Context.Value(key)
+}
+
+// WithSession returns ctx with the values of the session added. Values in the session take priority,
+// while the deadline and cancellation still come from ctx
+func WithSession(ctx context.Context, values context.Context) context.Context {
+	return valuesContext{Context: ctx, values: values}
+}
+
+// Attach adds the values of the client's session to the request context, returning false if the client has none
+func (s *Store) Attach(r *http.Request, clientID string) (*http.Request, bool) {
+	values, ok := s.Get(clientID)
+	if !ok {
+		return r, false
+	}
+	return r.WithContext(WithSession(r.Context(), values)), true
+}
+
+// Middleware adds the values of the client's session to the request context, answering with a 401
+// if the client hasn't got one. A nil Store lets every request through unchanged.
+// It must run after the client ID middleware
+func Middleware(store *Store, p protocol.Protocol) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if store == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			withSession, ok := store.Attach(r, clientid.GetClientIDFromRequest(r))
+			if !ok {
+				responseProtocol := p
+				if responseProtocol == nil {
+					responseProtocol = protocol.ProtocolFromRequest(r)
+				}
+				res := protocol.UnauthorizedResponse(responseProtocol)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(res.StatusCode)
+				w.Write(res.Message)
+				return
+			}
+			next.ServeHTTP(w, withSession)
+		})
+	}
+}
+
+// Attached reports whether the values of a session have been added to ctx by Attach
+func Attached(ctx context.Context) bool {
+	_, ok := ctx.(valuesContext)
+	return ok
+}
+
+// Detached returns ctx without the session values added by Attach, so a new session doesn't inherit them
+func Detached(ctx context.Context) context.Context {
+	if withSession, ok := ctx.(valuesContext); ok {
+		return withSession.Context
+	}
+	return ctx
+}
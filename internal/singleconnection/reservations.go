@@ -0,0 +1,123 @@
+package singleconnection
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// reservationTimeout is how long a reserved token stays valid if no stream is opened with it
+const reservationTimeout = time.Minute
+
+var (
+	errTokenNotFound = errors.New("Stream token not found")
+	errStreamOpen    = errors.New("Stream already open for token")
+	errOperationOpen = errors.New("Operation already running for token")
+)
+
+type reservation struct {
+	reservedAt time.Time
+	streaming  bool
+	session    context.Context
+	operations map[string]bool
+}
+
+// reservations keeps the tokens issued by PUT requests, and the operations started under each of them
+type reservations struct {
+	mux    sync.Mutex
+	tokens map[string]*reservation
+}
+
+func newReservations() *reservations {
+	return &reservations{
+		tokens: map[string]*reservation{},
+	}
+}
+
+// reserve stores a new token with its session, which may be nil, and forgets the tokens that were reserved but never
+// streamed from
+func (r *reservations) reserve(token string, now time.Time, session context.Context) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for existing, res := range r.tokens {
+		if !res.streaming && now.Sub(res.reservedAt) > reservationTimeout {
+			delete(r.tokens, existing)
+		}
+	}
+	r.tokens[token] = &reservation{
+		reservedAt: now,
+		session:    session,
+		operations: map[string]bool{},
+	}
+}
+
+// open marks the token's stream as open. A token can only have one stream
+func (r *reservations) open(token string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	res, ok := r.tokens[token]
+	if !ok {
+		return errTokenNotFound
+	}
+	if res.streaming {
+		return errStreamOpen
+	}
+	res.streaming = true
+	return nil
+}
+
+// session returns the session the token was reserved with, or nil if it has none
+func (r *reservations) session(token string) context.Context {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	res, ok := r.tokens[token]
+	if !ok {
+		return nil
+	}
+	return res.session
+}
+
+// release forgets the token once its stream has closed, returning the operations that were still running
+// and the token's session
+func (r *reservations) release(token string) ([]string, context.Context) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	res, ok := r.tokens[token]
+	if !ok {
+		return nil, nil
+	}
+	delete(r.tokens, token)
+	operations := make([]string, 0, len(res.operations))
+	for operationID := range res.operations {
+		operations = append(operations, operationID)
+	}
+	return operations, res.session
+}
+
+// addOperation records an operation started under the token. An operation ID can't be reused while it is running
+func (r *reservations) addOperation(token string, operationID string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	res, ok := r.tokens[token]
+	if !ok {
+		return errTokenNotFound
+	}
+	if res.operations[operationID] {
+		return errOperationOpen
+	}
+	res.operations[operationID] = true
+	return nil
+}
+
+// removeOperation forgets an operation, returning false if the token or operation is unknown
+func (r *reservations) removeOperation(token string, operationID string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	res, ok := r.tokens[token]
+	if !ok || !res.operations[operationID] {
+		return false
+	}
+	delete(res.operations, operationID)
+	return true
+}
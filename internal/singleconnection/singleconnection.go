@@ -0,0 +1,379 @@
+package singleconnection
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/NickBlow/gqlssehandlers/internal/orchestration"
+	"github.com/NickBlow/gqlssehandlers/internal/quotas"
+	"github.com/NickBlow/gqlssehandlers/internal/ratelimit"
+	"github.com/NickBlow/gqlssehandlers/internal/sessions"
+	"github.com/NickBlow/gqlssehandlers/persistedqueries"
+	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/NickBlow/gqlssehandlers/replay"
+	"github.com/NickBlow/gqlssehandlers/subscriptions"
+	"github.com/graphql-go/graphql/gqlerrors"
+	gonanoid "github.com/matoous/go-nanoid"
+)
+
+type subscriptionStorageAdapter interface {
+	NotifyNewSubscription(ctx context.Context, subscriberData subscriptions.Data, queryData subscriptions.Query) error
+	NotifyUnsubscribe(ctx context.Context, subscriberData subscriptions.Data) error
+}
+
+// Handler handles the graphql-sse "single connection" endpoint. A PUT reserves a stream token, a GET opens the stream
+// for that token, and POST and DELETE start and stop operations on it. The token is used as the client ID.
+// Starting an operation with the ID of one still running on the token is refused with a 409 Conflict.
+// A comment is sent whenever nothing has been written to a stream for KeepAliveInterval.
+// AuthorizeSubscription, if set, is called with each valid operation before it is stored, and refuses it by returning an error.
+// Quotas counts the operations running on each token. ConnectLimiter rate limits reserving tokens, by the RateLimitKey
+// or else the remote address, and StartLimiter and StopLimiter the operations, by the RateLimitKey or else the token.
+// OnConnect, if set, is called with the request context and no payload when a token is reserved, as the protocol has
+// no init message, and the values of the context it returns are added to the contexts of the token's operations
+type Handler struct {
+	Broker                *orchestration.Broker
+	StorageAdapter        subscriptionStorageAdapter
+	KeepAliveInterval     time.Duration
+	Limits                protocol.Limits
+	PersistedQueries      *persistedqueries.Resolver
+	Quotas                *quotas.Quotas
+	ConnectLimiter        *ratelimit.Limiter
+	StartLimiter          *ratelimit.Limiter
+	StopLimiter           *ratelimit.Limiter
+	RateLimitKey          ratelimit.KeyFunc
+	OnConnect             func(ctx context.Context, initPayload map[string]interface{}) (context.Context, error)
+	AuthorizeSubscription func(ctx context.Context, subscriberData subscriptions.Data, queryData subscriptions.Query) error
+	reservations          *reservations
+}
+
+// NewHandler creates a Handler with no reserved tokens
+func NewHandler(broker *orchestration.Broker, storageAdapter subscriptionStorageAdapter, keepAliveInterval time.Duration, limits protocol.Limits, persistedQueries *persistedqueries.Resolver) *Handler {
+	return &Handler{
+		Broker:            broker,
+		StorageAdapter:    storageAdapter,
+		KeepAliveInterval: keepAliveInterval,
+		Limits:            limits,
+		PersistedQueries:  persistedQueries,
+		reservations:      newReservations(),
+	}
+}
+
+// sseProtocol encodes the events and error responses of this endpoint
+var sseProtocol = protocol.GraphQLSSESingleConnection
+
+func tokenFromRequest(r *http.Request) string {
+	if token := r.Header.Get(protocol.GraphQLSSETokenHeader); token != "" {
+		return token
+	}
+	return r.URL.Query().Get(protocol.GraphQLSSETokenQueryString)
+}
+
+func writeResponse(w http.ResponseWriter, res *protocol.Response) {
+	for k, v := range res.ExtraHeaders {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.StatusCode)
+	w.Write(res.Message)
+}
+
+// rateLimit takes a token from the limiter for the key, and returns the response refusing the request if there were none left
+func rateLimit(limiter *ratelimit.Limiter, key string) *protocol.Response {
+	if allowed, retryAfter := limiter.Allow(key); !allowed {
+		return protocol.TooManyRequestsResponse(sseProtocol, retryAfter)
+	}
+	return nil
+}
+
+// operationKey returns the key an operation's start or stop is rate limited by
+func (s *Handler) operationKey(r *http.Request, token string) string {
+	if s.RateLimitKey == nil {
+		return token
+	}
+	return s.RateLimitKey(r)
+}
+
+// withSession adds the values of the token's session, if it has one, to ctx
+func (s *Handler) withSession(ctx context.Context, token string) context.Context {
+	if session := s.reservations.session(token); session != nil {
+		return sessions.WithSession(ctx, session)
+	}
+	return ctx
+}
+
+// writeEvent writes a single SSE event with the given name
+func writeEvent(w http.ResponseWriter, event string, data []byte) {
+	fmt.Fprintf(w, "event:%v\ndata:%v\n\n", event, string(data))
+}
+
+func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		s.handleReserve(w, r)
+	case http.MethodGet:
+		s.handleStream(w, r)
+	case http.MethodPost:
+		s.handleStart(w, r)
+	case http.MethodDelete:
+		s.handleStop(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Handler) handleReserve(w http.ResponseWriter, r *http.Request) {
+	if response := rateLimit(s.ConnectLimiter, ratelimit.KeyOrRemoteIP(r, s.RateLimitKey)); response != nil {
+		writeResponse(w, response)
+		return
+	}
+	var session context.Context
+	if s.OnConnect != nil {
+		var err error
+		session, err = s.OnConnect(r.Context(), nil)
+		if err != nil {
+			writeResponse(w, protocol.ConnectionRejectedResponse(sseProtocol, err))
+			return
+		}
+	}
+	token, err := gonanoid.Nanoid()
+	if err != nil {
+		fmt.Println("Couldn't generate stream token")
+		writeResponse(w, protocol.ServerErrorResponseFor(sseProtocol))
+		return
+	}
+	s.reservations.reserve(token, time.Now(), session)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(token))
+}
+
+func (s *Handler) handleStart(w http.ResponseWriter, r *http.Request) {
+	token := tokenFromRequest(r)
+	if response := rateLimit(s.StartLimiter, s.operationKey(r, token)); response != nil {
+		writeResponse(w, response)
+		return
+	}
+	r = r.WithContext(s.withSession(r.Context(), token))
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeResponse(w, protocol.ServerErrorResponseFor(sseProtocol))
+		return
+	}
+	message, err := sseProtocol.Decode(body)
+	if err != nil {
+		fmt.Println(err)
+		writeResponse(w, protocol.BadRequestResponseFor(sseProtocol))
+		return
+	}
+	var payload protocol.GQLStartPayload
+	if err := json.Unmarshal(message.Payload, &payload); err != nil {
+		fmt.Println(err)
+		writeResponse(w, protocol.BadRequestResponseFor(sseProtocol))
+		return
+	}
+	operationID, _ := payload.Extensions["operationId"].(string)
+	if operationID == "" {
+		writeResponse(w, protocol.BadRequestResponseFor(sseProtocol))
+		return
+	}
+	if resolveResponse := s.PersistedQueries.Resolve(sseProtocol, &payload); resolveResponse != nil {
+		writeResponse(w, resolveResponse)
+		return
+	}
+	parsed, validationResponse := protocol.ValidatePayloadFor(sseProtocol, payload, s.Broker.Schema, s.Limits)
+	if validationResponse != nil {
+		writeResponse(w, validationResponse)
+		return
+	}
+	subscriberData := subscriptions.Data{
+		SubscriptionID: operationID,
+		ClientID:       token,
+	}
+	queryData := subscriptions.Query{
+		RequestString:  payload.Query,
+		VariableValues: payload.Variables,
+		OperationName:  payload.OperationName,
+	}
+	if s.AuthorizeSubscription != nil {
+		if err := s.AuthorizeSubscription(subscriptions.WithParsedQuery(r.Context(), parsed), subscriberData, queryData); err != nil {
+			writeResponse(w, protocol.ForbiddenResponse(sseProtocol, err))
+			return
+		}
+	}
+	switch s.reservations.addOperation(token, operationID) {
+	case errTokenNotFound:
+		writeResponse(w, protocol.NotFoundResponse(sseProtocol))
+		return
+	case errOperationOpen:
+		writeResponse(w, protocol.ErrorResponse(sseProtocol, http.StatusConflict, gqlerrors.NewFormattedError(errOperationOpen.Error())))
+		return
+	}
+	if _, quotaResponse := s.Quotas.Acquire(r.Context(), sseProtocol, token, operationID); quotaResponse != nil {
+		s.reservations.removeOperation(token, operationID)
+		writeResponse(w, quotaResponse)
+		return
+	}
+	err = s.StorageAdapter.NotifyNewSubscription(r.Context(), subscriberData, queryData)
+	if err != nil {
+		fmt.Println(err)
+		s.reservations.removeOperation(token, operationID)
+		s.Quotas.Release(token, operationID)
+		writeResponse(w, protocol.BadRequestResponseFor(sseProtocol))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Handler) handleStop(w http.ResponseWriter, r *http.Request) {
+	token := tokenFromRequest(r)
+	if response := rateLimit(s.StopLimiter, s.operationKey(r, token)); response != nil {
+		writeResponse(w, response)
+		return
+	}
+	operationID := r.URL.Query().Get(protocol.GraphQLSSEOperationIDQueryString)
+	if !s.reservations.removeOperation(token, operationID) {
+		writeResponse(w, protocol.NotFoundResponse(sseProtocol))
+		return
+	}
+	s.Quotas.Release(token, operationID)
+	s.StorageAdapter.NotifyUnsubscribe(s.withSession(r.Context(), token), subscriptions.Data{
+		SubscriptionID: operationID,
+		ClientID:       token,
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Handler) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
+	token := tokenFromRequest(r)
+	switch s.reservations.open(token) {
+	case errTokenNotFound:
+		writeResponse(w, protocol.NotFoundResponse(sseProtocol))
+		return
+	case errStreamOpen:
+		writeResponse(w, protocol.ConflictResponseFor(sseProtocol))
+		return
+	}
+	defer s.unsubscribeAll(token)
+	clientInfo := orchestration.ClientInfo{
+		ClientID:     token,
+		ConnectionID: token,
+		Outbox:       s.Broker.NewOutbox(),
+		CloseChannel: make(chan bool, 1),
+	}
+	if err := s.Broker.Connect(clientInfo); err != nil {
+		writeResponse(w, protocol.ShuttingDownResponseFor(sseProtocol))
+		return
+	}
+	defer s.Broker.Disconnected(clientInfo)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-clientInfo.CloseChannel:
+			// the frames queued before the broker closed the stream are still written out
+			s.writeQueued(w, flusher, token, clientInfo.Outbox)
+			return
+		case <-time.After(s.KeepAliveInterval):
+			fmt.Fprint(w, ":\n\n")
+			flusher.Flush()
+		case <-clientInfo.Outbox.Ready():
+			if ended := s.writeQueued(w, flusher, token, clientInfo.Outbox); ended {
+				return
+			}
+		}
+	}
+}
+
+// writeQueued writes the frames queued on the outbox, stopping at one that ends the stream, and returns whether it ended
+func (s *Handler) writeQueued(w http.ResponseWriter, flusher http.Flusher, token string, outbox *orchestration.Outbox) bool {
+	defer flusher.Flush()
+	for _, frame := range outbox.Drain() {
+		if done := s.writeFrame(w, token, frame); done {
+			return true
+		}
+	}
+	return false
+}
+
+// unsubscribeAll releases the token once its stream has closed, and stops the operations still running on it
+func (s *Handler) unsubscribeAll(token string) {
+	s.Quotas.ReleaseClient(token)
+	operations, session := s.reservations.release(token)
+	ctx := context.Background()
+	if session != nil {
+		ctx = sessions.WithSession(ctx, session)
+	}
+	for _, operationID := range operations {
+		s.StorageAdapter.NotifyUnsubscribe(ctx, subscriptions.Data{
+			SubscriptionID: operationID,
+			ClientID:       token,
+		})
+	}
+}
+
+// endOperation forgets an operation that has completed or failed
+func (s *Handler) endOperation(token string, operationID string) {
+	s.reservations.removeOperation(token, operationID)
+	s.Quotas.Release(token, operationID)
+}
+
+// writeNext writes the frame's payload as a next event for its operation
+func writeNext(w http.ResponseWriter, frame replay.Frame) {
+	data, err := sseProtocol.Encode(&protocol.Message{Type: protocol.MessageData, ID: frame.SubscriptionID, Payload: frame.Payload})
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("Could not marshall frame")
+		return
+	}
+	writeEvent(w, protocol.GraphQLSSENext, data)
+}
+
+// writeFrame writes a next or complete event for the frame, and returns true if the stream should end.
+// A complete frame carrying a final result gets a next event for it first, and an error frame is completed after it
+func (s *Handler) writeFrame(w http.ResponseWriter, token string, frame replay.Frame) bool {
+	switch frame.Type {
+	case protocol.MessageData:
+		writeNext(w, frame)
+		return false
+	case protocol.MessageComplete:
+		if len(frame.Payload) > 0 && string(frame.Payload) != "null" {
+			writeNext(w, frame)
+		}
+		data, _ := sseProtocol.Encode(&protocol.Message{Type: protocol.MessageComplete, ID: frame.SubscriptionID})
+		writeEvent(w, protocol.GraphQLSSEComplete, data)
+		s.endOperation(token, frame.SubscriptionID)
+		return false
+	case protocol.MessageError:
+		// the operation has ended, so it is completed after its errors
+		data, err := sseProtocol.Encode(&protocol.Message{Type: protocol.MessageError, ID: frame.SubscriptionID, Errors: frame.Errors})
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("Could not marshall frame")
+			return false
+		}
+		writeEvent(w, protocol.GraphQLSSENext, data)
+		data, _ = sseProtocol.Encode(&protocol.Message{Type: protocol.MessageComplete, ID: frame.SubscriptionID})
+		writeEvent(w, protocol.GraphQLSSEComplete, data)
+		s.endOperation(token, frame.SubscriptionID)
+		return false
+	case protocol.MessageConnectionTerminate, protocol.MessageConnectionError, protocol.MessageServerShutdown:
+		return true
+	default:
+		return false
+	}
+}
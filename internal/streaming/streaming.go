@@ -6,13 +6,38 @@ import (
 	"time"
 
 	"github.com/NickBlow/gqlssehandlers/clientid"
+	"github.com/NickBlow/gqlssehandlers/credentials"
 	"github.com/NickBlow/gqlssehandlers/internal/orchestration"
+	"github.com/NickBlow/gqlssehandlers/internal/ratelimit"
 	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/NickBlow/gqlssehandlers/replay"
+	gonanoid "github.com/matoous/go-nanoid"
 )
 
-// Handler handles the endpoint for streaming and contains a reference to the SubscriptionBroker
+// Handler handles the endpoint for streaming and contains a reference to the SubscriptionBroker.
+// If Protocol is nil, the stream is encoded with the protocol named in the request's ProtocolQueryString.
+// Frames are sent as SSE, or as multipart/mixed parts in the shape of Apollo's multipart subscription spec
+// if the Accept header asks for it.
+// A keepalive is sent whenever nothing has been written for KeepAliveInterval.
+// ConnectLimiter rate limits new streams by the RateLimitKey.
+// If the request context has a credentials expiry, the stream is sent a protocol.MessageCredentialsExpired frame
+// and closed when it passes
 type Handler struct {
-	Broker *orchestration.Broker
+	Broker            *orchestration.Broker
+	Protocol          protocol.Protocol
+	KeepAliveInterval time.Duration
+	SSE               SSEOptions
+	ConnectLimiter    *ratelimit.Limiter
+	RateLimitKey      ratelimit.KeyFunc
+}
+
+func writeResponse(w http.ResponseWriter, res *protocol.Response) {
+	for k, v := range res.ExtraHeaders {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.StatusCode)
+	w.Write(res.Message)
 }
 
 func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -22,33 +47,70 @@ func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	closed := w.(http.CloseNotifier).CloseNotify()
-	terminate := make(chan bool)
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	messageChan := make(chan []byte)
+	p := s.Protocol
+	if p == nil {
+		p = protocol.ProtocolFromRequest(r)
+	}
 	clientID := clientid.GetClientIDFromRequest(r)
-	s.Broker.NewClients <- orchestration.ClientInfo{
-		ClientID:             clientID,
-		CommunicationChannel: messageChan,
-		CloseChannel:         terminate,
+	if clientID == "" || credentials.Expired(r.Context(), time.Now()) {
+		writeResponse(w, protocol.UnauthorizedResponse(p))
+		return
+	}
+	if allowed, retryAfter := s.ConnectLimiter.Allow(ratelimit.Key(r, s.RateLimitKey)); !allowed {
+		writeResponse(w, protocol.TooManyRequestsResponse(p, retryAfter))
+		return
+	}
+	connectionID, err := gonanoid.Nanoid()
+	if err != nil {
+		fmt.Println("Couldn't generate connection ID")
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	clientInfo := orchestration.ClientInfo{
+		ClientID:        clientID,
+		ConnectionID:    connectionID,
+		Outbox:          s.Broker.NewOutbox(),
+		LastSeenEventID: r.Header.Get(protocol.LastEventIDHeader),
+		CloseChannel:    make(chan bool, 1),
+	}
+	if err := s.Broker.Connect(clientInfo); err != nil {
+		res := protocol.ConflictResponseFor(p)
+		if err == orchestration.ErrShuttingDown {
+			res = protocol.ShuttingDownResponseFor(p)
+		}
+		writeResponse(w, res)
+		return
+	}
+	writer := newFrameWriter(w, flusher, p, r, s.SSE)
+	writer.start()
+	// a nil channel never fires, so streams without credentials never expire
+	var credentialsExpired <-chan time.Time
+	if expiry, ok := credentials.ExpiryFromContext(r.Context()); ok {
+		timer := time.NewTimer(time.Until(expiry))
+		defer timer.Stop()
+		credentialsExpired = timer.C
 	}
 
 Loop:
 	for {
 		select {
 		case <-closed:
-			s.Broker.ClosedClients <- clientID
+			s.Broker.Disconnected(clientInfo)
+			break Loop
+		case <-clientInfo.CloseChannel:
+			writer.write(clientInfo.Outbox.Drain())
+			writer.finish()
+			s.Broker.Disconnected(clientInfo)
 			break Loop
-		case <-terminate:
-			s.Broker.ClosedClients <- clientID
+		case <-credentialsExpired:
+			writer.write(append(clientInfo.Outbox.Drain(), replay.Frame{Type: protocol.MessageCredentialsExpired}))
+			writer.finish()
+			s.Broker.Disconnected(clientInfo)
 			break Loop
-		case <-time.After(time.Second * 15):
-			fmt.Fprintf(w, "data:%v \n\n", protocol.KeepAlivePayload)
-			flusher.Flush()
-		case data := <-messageChan:
-			fmt.Fprintf(w, "data:%v \n\n", string(data))
-			flusher.Flush()
+		case <-time.After(s.KeepAliveInterval):
+			writer.keepAlive()
+		case <-clientInfo.Outbox.Ready():
+			writer.write(clientInfo.Outbox.Drain())
 		}
 	}
 	fmt.Println("stopped main thread")
@@ -0,0 +1,206 @@
+package streaming
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/NickBlow/gqlssehandlers/replay"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// multipartBoundary is the boundary between parts of a multipart/mixed stream, as expected by Apollo clients
+const multipartBoundary = "graphql"
+
+// SSEOptions tunes how frames are written as server sent events.
+// CommentKeepAlives sends keepalives as ": ping" comment lines rather than keepalive messages,
+// NamedEvents sets the event field of each message to its type in the stream's protocol,
+// and InitialRetry, if set, is sent as a retry hint when the stream opens
+type SSEOptions struct {
+	CommentKeepAlives bool
+	NamedEvents       bool
+	InitialRetry      time.Duration
+}
+
+// frameWriter writes frames to the response in one of the supported streaming formats
+type frameWriter interface {
+	// start sets the response headers, and writes anything sent when the stream opens
+	start()
+	// write writes the frames, then flushes them to the client
+	write(frames []replay.Frame)
+	// keepAlive writes a keepalive, then flushes it to the client
+	keepAlive()
+	// finish ends the stream, once the server has closed it
+	finish()
+}
+
+// newFrameWriter picks the streaming format from the Accept header, multipart/mixed if the client asks for it
+// and SSE otherwise
+func newFrameWriter(w http.ResponseWriter, flusher http.Flusher, p protocol.Protocol, r *http.Request, options SSEOptions) frameWriter {
+	if strings.Contains(r.Header.Get("Accept"), "multipart/mixed") {
+		return &multipartWriter{w: w, flusher: flusher}
+	}
+	return &sseWriter{w: w, flusher: flusher, p: p, options: options}
+}
+
+// writeSSEData writes data as the data field of an SSE message, with a data line for each of its lines
+func writeSSEData(w io.Writer, data []byte) {
+	for _, line := range strings.Split(string(data), "\n") {
+		fmt.Fprintf(w, "data:%v\n", strings.TrimSuffix(line, "\r"))
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// marshalFrame encodes the frame as a message of the given protocol
+func marshalFrame(p protocol.Protocol, frame replay.Frame) ([]byte, error) {
+	return p.Encode(&protocol.Message{
+		Type:    frame.Type,
+		ID:      frame.SubscriptionID,
+		Payload: frame.Payload,
+		Errors:  frame.Errors,
+	})
+}
+
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	p       protocol.Protocol
+	options SSEOptions
+}
+
+func (s *sseWriter) start() {
+	s.w.Header().Set("Content-Type", "text/event-stream")
+	s.w.Header().Set("Cache-Control", "no-cache")
+	s.w.Header().Set("Connection", "keep-alive")
+	if s.options.InitialRetry > 0 {
+		fmt.Fprintf(s.w, "retry:%d\n\n", s.options.InitialRetry/time.Millisecond)
+		s.flusher.Flush()
+	}
+}
+
+// write writes each frame as an SSE message
+func (s *sseWriter) write(frames []replay.Frame) {
+	for _, frame := range frames {
+		data, err := marshalFrame(s.p, frame)
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("Could not marshall frame")
+			continue
+		}
+		if frame.ID != "" {
+			fmt.Fprintf(s.w, "id:%v\n", frame.ID)
+		}
+		if frame.Retry > 0 {
+			fmt.Fprintf(s.w, "retry:%d\n", frame.Retry/time.Millisecond)
+		}
+		if s.options.NamedEvents {
+			if name, ok := s.p.TypeName(frame.Type); ok {
+				fmt.Fprintf(s.w, "event:%v\n", name)
+			}
+		}
+		writeSSEData(s.w, data)
+	}
+	s.flusher.Flush()
+}
+
+func (s *sseWriter) keepAlive() {
+	if s.options.CommentKeepAlives {
+		fmt.Fprint(s.w, ": ping\n\n")
+		s.flusher.Flush()
+		return
+	}
+	s.write([]replay.Frame{{Type: protocol.MessageKeepAlive}})
+}
+
+func (s *sseWriter) finish() {}
+
+// multipartPart is a part in the shape of Apollo's multipart subscription spec. Payload is null when Errors ends
+// the subscription
+type multipartPart struct {
+	Payload json.RawMessage            `json:"payload"`
+	Errors  []gqlerrors.FormattedError `json:"errors,omitempty"`
+}
+
+// multipartHeartbeat is the part sent as a keepalive
+const multipartHeartbeat = "{}"
+
+// multipartClosingReasons are the errors sent for the frames that end the stream
+var multipartClosingReasons = map[protocol.MessageType]string{
+	protocol.MessageConnectionTerminate: "Stream replaced by a newer one",
+	protocol.MessageConnectionError:     "Stream closed for falling too far behind",
+	protocol.MessageServerShutdown:      "Server is shutting down",
+	protocol.MessageCredentialsExpired:  "Credentials expired",
+}
+
+// multipartWriter writes frames in the shape of Apollo's multipart subscription spec, which has no subscription IDs,
+// so clients using it should run one subscription per client ID
+type multipartWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (m *multipartWriter) start() {
+	m.w.Header().Set("Content-Type", `multipart/mixed; boundary="`+multipartBoundary+`"; subscriptionSpec="1.0"`)
+	m.w.Header().Set("Cache-Control", "no-cache")
+	m.w.Header().Set("Connection", "keep-alive")
+}
+
+// multipartPartFor returns the part for the frame, and false if the spec has no equivalent of it.
+// Results are sent as their payload, and errors and the frames ending the stream as errors with a null payload.
+// Event ids and retry hints have no equivalent, so they are left out
+func multipartPartFor(frame replay.Frame) (multipartPart, bool) {
+	switch frame.Type {
+	case protocol.MessageData, protocol.MessageComplete:
+		if len(frame.Payload) == 0 || string(frame.Payload) == "null" {
+			return multipartPart{}, false
+		}
+		return multipartPart{Payload: frame.Payload}, true
+	case protocol.MessageError:
+		return multipartPart{Payload: json.RawMessage("null"), Errors: frame.Errors}, true
+	}
+	if reason, ok := multipartClosingReasons[frame.Type]; ok {
+		return multipartPart{
+			Payload: json.RawMessage("null"),
+			Errors:  []gqlerrors.FormattedError{gqlerrors.NewFormattedError(reason)},
+		}, true
+	}
+	return multipartPart{}, false
+}
+
+// writePart writes the data as a JSON part
+func (m *multipartWriter) writePart(data []byte) {
+	fmt.Fprintf(m.w, "\r\n--%v\r\nContent-Type: application/json; charset=utf-8\r\n\r\n%v", multipartBoundary, string(data))
+}
+
+// write writes each frame with an equivalent in the spec as a JSON part
+func (m *multipartWriter) write(frames []replay.Frame) {
+	for _, frame := range frames {
+		part, ok := multipartPartFor(frame)
+		if !ok {
+			continue
+		}
+		data, err := json.Marshal(part)
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("Could not marshall frame")
+			continue
+		}
+		m.writePart(data)
+	}
+	m.flusher.Flush()
+}
+
+func (m *multipartWriter) keepAlive() {
+	m.writePart([]byte(multipartHeartbeat))
+	m.flusher.Flush()
+}
+
+// finish writes the closing boundary
+func (m *multipartWriter) finish() {
+	fmt.Fprintf(m.w, "\r\n--%v--\r\n", multipartBoundary)
+	m.flusher.Flush()
+}
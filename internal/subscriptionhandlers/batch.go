@@ -0,0 +1,149 @@
+package subscriptionhandlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/NickBlow/gqlssehandlers/clientid"
+	"github.com/NickBlow/gqlssehandlers/internal/quotas"
+	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/NickBlow/gqlssehandlers/subscriptions"
+)
+
+// batchResult is the outcome of a single message in a batch
+type batchResult struct {
+	ID     string          `json:"id,omitempty"`
+	Status int             `json:"status"`
+	Result json.RawMessage `json:"result"`
+}
+
+// pendingStart is a validated start message waiting to be stored with the others next to it in the batch
+type pendingStart struct {
+	index    int
+	p        protocol.Protocol
+	request  *subscriptions.Request
+	reserved bool
+}
+
+// release gives back the quota slot the start counted, if it counted one
+func (start pendingStart) release(q *quotas.Quotas) {
+	if start.reserved {
+		q.Release(start.request.Data.ClientID, start.request.Data.SubscriptionID)
+	}
+}
+
+// batchHeaders are the headers of a message's response that apply to the whole batch, and are copied to its response.
+// The others, such as a rate limited message's Retry-After, only describe that message's result
+var batchHeaders = []string{"Set-Cookie", clientid.ClientIDHeader}
+
+// isBatch reports whether the body is a JSON array of messages rather than a single one
+func isBatch(body []byte) bool {
+	trimmed := bytes.TrimSpace(body)
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// handleBatch handles an array of messages in order, answering with an array of results in the same order.
+// Consecutive start messages are stored together, in one call if the adapter implements NotifyNewSubscriptions
+func (s *Handler) handleBatch(r *http.Request, clientID string, body []byte) *protocol.Response {
+	var messages []json.RawMessage
+	if err := json.Unmarshal(body, &messages); err != nil {
+		fmt.Println(err)
+		return protocol.BadRequestResponseFor(protocol.Legacy)
+	}
+	responses := make([]*protocol.Response, len(messages))
+	ids := make([]string, len(messages))
+	var pending []pendingStart
+	for i, message := range messages {
+		p, req, response := s.decodeMessage(message)
+		if response != nil {
+			responses[i] = response
+			continue
+		}
+		ids[i] = req.ID
+		if response := s.requireInit(r, p, req, clientID); response != nil {
+			responses[i] = response
+			continue
+		}
+		if req.Type != protocol.MessageStart {
+			s.storeStarts(r, pending, responses)
+			pending = nil
+			responses[i] = s.handleMessage(r, p, req, clientID)
+			continue
+		}
+		if response := s.rateLimit(s.StartLimiter, p, r); response != nil {
+			responses[i] = response
+			continue
+		}
+		request, reserved, response := s.prepareGQLStart(r.Context(), p, req, clientID)
+		if response != nil {
+			responses[i] = response
+			continue
+		}
+		pending = append(pending, pendingStart{index: i, p: p, request: request, reserved: reserved})
+	}
+	s.storeStarts(r, pending, responses)
+
+	results := make([]batchResult, len(messages))
+	extraHeaders := map[string]string{}
+	for i, response := range responses {
+		for _, k := range batchHeaders {
+			if v, ok := response.ExtraHeaders[k]; ok {
+				extraHeaders[k] = v
+			}
+		}
+		results[i] = batchResult{
+			ID:     ids[i],
+			Status: response.StatusCode,
+			Result: response.Message,
+		}
+	}
+	encoded, err := json.Marshal(results)
+	if err != nil {
+		fmt.Println(err)
+		return protocol.ServerErrorResponseFor(protocol.Legacy)
+	}
+	return &protocol.Response{
+		ExtraHeaders: extraHeaders,
+		Message:      encoded,
+		StatusCode:   http.StatusOK,
+	}
+}
+
+// storeStarts notifies the adapter of the pending start messages, and records a response for each of them
+func (s *Handler) storeStarts(r *http.Request, pending []pendingStart, responses []*protocol.Response) {
+	if len(pending) == 0 {
+		return
+	}
+	errs := make([]error, len(pending))
+	if bulkAdapter, ok := s.StorageAdapter.(bulkSubscriptionStorageAdapter); ok {
+		requests := make([]subscriptions.Request, len(pending))
+		for i, start := range pending {
+			requests[i] = *start.request
+		}
+		errs = bulkAdapter.NotifyNewSubscriptions(r.Context(), requests)
+		if len(errs) != len(pending) {
+			fmt.Println("NotifyNewSubscriptions returned the wrong number of errors")
+			for i := range pending {
+				pending[i].release(s.Quotas)
+				responses[pending[i].index] = protocol.ServerErrorResponseFor(pending[i].p)
+			}
+			return
+		}
+	} else {
+		for i, start := range pending {
+			errs[i] = s.StorageAdapter.NotifyNewSubscription(r.Context(), start.request.Data, start.request.Query)
+		}
+	}
+	for i, start := range pending {
+		if errs[i] != nil {
+			fmt.Println(errs[i])
+			start.release(s.Quotas)
+			responses[start.index] = protocol.BadRequestResponseFor(start.p)
+			continue
+		}
+		s.Active.add(r.Context(), *start.request)
+		responses[start.index] = protocol.OKResponseFor(start.p)
+	}
+}
@@ -0,0 +1,38 @@
+package subscriptionhandlers
+
+import (
+	"github.com/NickBlow/gqlssehandlers/subscriptions"
+	"github.com/graphql-go/graphql"
+)
+
+// PublishRawEvent calls Filter with every active subscription, and executes the query of each one it matches in turn,
+// sending the result to the client. The event is in the context of the resolvers, see subscriptions.RawEventFromContext,
+// and its payload is the root object if it is a map
+func (s *Handler) PublishRawEvent(event subscriptions.RawEvent) error {
+	root, _ := event.Payload.(map[string]interface{})
+	for _, subscription := range s.Active.snapshot() {
+		ctx := s.currentContext(subscription)
+		data := subscription.request.Data
+		query := subscription.request.Query
+		if !s.Filter(ctx, data, query, event) {
+			continue
+		}
+		result := graphql.Do(graphql.Params{
+			Schema:         *s.Broker.Schema,
+			RequestString:  query.RequestString,
+			VariableValues: query.VariableValues,
+			OperationName:  query.OperationName,
+			RootObject:     root,
+			Context:        subscriptions.WithRawEvent(ctx, event),
+		})
+		err := s.Broker.PushDataToClient(subscriptions.WrappedEvent{
+			SubscriptionID: data.SubscriptionID,
+			ClientID:       data.ClientID,
+			QueryResult:    result,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
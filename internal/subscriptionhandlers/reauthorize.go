@@ -0,0 +1,151 @@
+package subscriptionhandlers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/NickBlow/gqlssehandlers/internal/sessions"
+	"github.com/NickBlow/gqlssehandlers/subscriptions"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// RevokedCode is the error code set in the extensions of the error frame sent when a subscription is revoked
+const RevokedCode = "SUBSCRIPTION_REVOKED"
+
+// startedSubscription is an active subscription, with the context it was started with
+type startedSubscription struct {
+	ctx     context.Context
+	request subscriptions.Request
+}
+
+// ActiveSubscriptions keeps the subscriptions started through the handler, so they can be authorized again
+// and matched against raw events.
+// A nil *ActiveSubscriptions keeps nothing.
+type ActiveSubscriptions struct {
+	mu      sync.Mutex
+	clients map[string]map[string]startedSubscription
+}
+
+// add records a subscription once it has been stored. Only the values of ctx are kept
+func (a *ActiveSubscriptions) add(ctx context.Context, request subscriptions.Request) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.clients == nil {
+		a.clients = map[string]map[string]startedSubscription{}
+	}
+	active, ok := a.clients[request.Data.ClientID]
+	if !ok {
+		active = map[string]startedSubscription{}
+		a.clients[request.Data.ClientID] = active
+	}
+	active[request.Data.SubscriptionID] = startedSubscription{
+		ctx:     sessions.WithSession(context.Background(), ctx),
+		request: request,
+	}
+}
+
+// Release forgets a subscription, when it is stopped or completed
+func (a *ActiveSubscriptions) Release(clientID string, subscriptionID string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.clients[clientID], subscriptionID)
+	if len(a.clients[clientID]) == 0 {
+		delete(a.clients, clientID)
+	}
+}
+
+// client returns the client's active subscriptions
+func (a *ActiveSubscriptions) client(clientID string) []startedSubscription {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	started := make([]startedSubscription, 0, len(a.clients[clientID]))
+	for _, subscription := range a.clients[clientID] {
+		started = append(started, subscription)
+	}
+	return started
+}
+
+// ReleaseClient forgets all of a client's subscriptions, when it hasn't reconnected in time
+func (a *ActiveSubscriptions) ReleaseClient(clientID string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.clients, clientID)
+}
+
+// snapshot returns the active subscriptions, so they can be checked without holding the lock
+func (a *ActiveSubscriptions) snapshot() []startedSubscription {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var started []startedSubscription
+	for _, active := range a.clients {
+		for _, subscription := range active {
+			started = append(started, subscription)
+		}
+	}
+	return started
+}
+
+// currentContext returns the context a subscription is authorized again or filtered with. It has the values of the
+// client's current session, if it has one, so credentials refreshed by a later connection init message are used
+func (s *Handler) currentContext(subscription startedSubscription) context.Context {
+	if s.Sessions == nil {
+		return subscription.ctx
+	}
+	if values, ok := s.Sessions.Get(subscription.request.Data.ClientID); ok {
+		return sessions.WithSession(subscription.ctx, values)
+	}
+	return subscription.ctx
+}
+
+// revoke ends a subscription the client is no longer allowed, sending it a MessageError frame
+func (s *Handler) revoke(subscription startedSubscription, reason error) {
+	data := subscription.request.Data
+	formatted := gqlerrors.NewFormattedError(reason.Error())
+	formatted.Extensions = map[string]interface{}{"code": RevokedCode}
+	if err := s.Broker.RevokeSubscription(data.ClientID, data.SubscriptionID, []gqlerrors.FormattedError{formatted}); err != nil {
+		fmt.Println(err)
+	}
+	if err := s.StorageAdapter.NotifyUnsubscribe(subscription.ctx, data); err != nil {
+		fmt.Println(err)
+	}
+	s.Active.Release(data.ClientID, data.SubscriptionID)
+	s.Quotas.Release(data.ClientID, data.SubscriptionID)
+}
+
+// Reauthorize calls ReauthorizeSubscription with every active subscription each interval, revoking the ones it refuses,
+// until stop is closed. It blocks, so run it in its own goroutine
+func (s *Handler) Reauthorize(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, subscription := range s.Active.snapshot() {
+				data := subscription.request.Data
+				err := s.ReauthorizeSubscription(s.currentContext(subscription), data, subscription.request.Query)
+				if err != nil {
+					s.revoke(subscription, err)
+				}
+			}
+		}
+	}
+}
@@ -10,6 +10,10 @@ import (
 
 	"github.com/NickBlow/gqlssehandlers/clientid"
 	"github.com/NickBlow/gqlssehandlers/internal/orchestration"
+	"github.com/NickBlow/gqlssehandlers/internal/quotas"
+	"github.com/NickBlow/gqlssehandlers/internal/ratelimit"
+	"github.com/NickBlow/gqlssehandlers/internal/sessions"
+	"github.com/NickBlow/gqlssehandlers/persistedqueries"
 	"github.com/NickBlow/gqlssehandlers/protocol"
 	"github.com/NickBlow/gqlssehandlers/subscriptions"
 )
@@ -19,74 +23,289 @@ type subscriptionStorageAdapter interface {
 	NotifyUnsubscribe(ctx context.Context, subscriberData subscriptions.Data) error
 }
 
-// Handler handles the endpoint for processing new subscriptions and contains a reference to the Broker
+type bulkSubscriptionStorageAdapter interface {
+	NotifyNewSubscriptions(ctx context.Context, requests []subscriptions.Request) []error
+}
+
+// Handler handles the endpoint for processing new subscriptions and contains a reference to the Broker.
+// If Protocol is nil, the protocol is detected from the type of each message.
+// Subscriptions exceeding the Limits are rejected before they reach the StorageAdapter.
+// PersistedQueries resolves start messages that send a query hash instead of the query.
+// Quotas, if set, limits the number of active subscriptions, and must be released as subscriptions complete
+// and clients disconnect. StartLimiter and StopLimiter rate limit start and stop messages by the RateLimitKey.
+// ClientIDProvider issues client IDs in answer to connection init messages from requests without one.
+// If OnConnect is set, it is called with the payload of each connection init message, and the context it returns
+// is kept in Sessions, so its values are in the context of every later message from the client.
+// Clients have to send a connection init message before anything else.
+// AuthorizeSubscription, if set, is called with each valid subscription before it is stored, and refuses it by returning an error.
+// Active keeps the stored subscriptions, if it is set, so Reauthorize can check them with ReauthorizeSubscription,
+// and PublishRawEvent can match them against raw events with Filter. It must be set along with OnConnect, so the
+// subscriptions of a client that connects again without keeping its client ID can be ended
 type Handler struct {
-	Broker         *orchestration.Broker
-	StorageAdapter subscriptionStorageAdapter
+	Broker                  *orchestration.Broker
+	StorageAdapter          subscriptionStorageAdapter
+	Protocol                protocol.Protocol
+	Limits                  protocol.Limits
+	PersistedQueries        *persistedqueries.Resolver
+	Quotas                  *quotas.Quotas
+	StartLimiter            *ratelimit.Limiter
+	StopLimiter             *ratelimit.Limiter
+	RateLimitKey            ratelimit.KeyFunc
+	ClientIDProvider        clientid.Provider
+	OnConnect               func(ctx context.Context, initPayload map[string]interface{}) (context.Context, error)
+	Sessions                *sessions.Store
+	AuthorizeSubscription   func(ctx context.Context, subscriberData subscriptions.Data, queryData subscriptions.Query) error
+	ReauthorizeSubscription func(ctx context.Context, subscriberData subscriptions.Data, queryData subscriptions.Query) error
+	Active                  *ActiveSubscriptions
+	Filter                  func(ctx context.Context, subscriberData subscriptions.Data, queryData subscriptions.Query, rawEvent subscriptions.RawEvent) bool
+}
+
+// requireInit returns the response for a message that has to be preceded by a connection init message,
+// because the request has no client ID or the client has no session
+func (s *Handler) requireInit(r *http.Request, p protocol.Protocol, req *protocol.Message, clientID string) *protocol.Response {
+	if req.Type == protocol.MessageConnectionInit {
+		return nil
+	}
+	if clientID == "" || (s.OnConnect != nil && !sessions.Attached(r.Context())) {
+		return protocol.UnauthorizedResponse(p)
+	}
+	return nil
+}
+
+// connect calls the OnConnect hook with the init payload, and returns the values of the client's new session
+func (s *Handler) connect(r *http.Request, p protocol.Protocol, req *protocol.Message) (context.Context, *protocol.Response) {
+	var initPayload map[string]interface{}
+	if len(req.Payload) > 0 {
+		if err := json.Unmarshal(req.Payload, &initPayload); err != nil {
+			fmt.Println(err)
+			return nil, protocol.BadRequestResponseFor(p)
+		}
+	}
+	ctx, err := s.OnConnect(sessions.Detached(r.Context()), initPayload)
+	if err != nil {
+		return nil, protocol.ConnectionRejectedResponse(p, err)
+	}
+	return ctx, nil
 }
 
-func (s *Handler) handleGQLStart(ctx context.Context, req *protocol.GQLOverWebsocketProtocol, clientID string) *protocol.Response {
+// reclaimer is implemented by the client ID provider used with sessions, see sessions.Provider.Reclaim
+type reclaimer interface {
+	Reclaim(r *http.Request) (string, bool)
+}
+
+// releaseClient ends all of a client's subscriptions and streams, when it connects again and can't keep its client ID
+func (s *Handler) releaseClient(clientID string) {
+	for _, subscription := range s.Active.client(clientID) {
+		if err := s.StorageAdapter.NotifyUnsubscribe(subscription.ctx, subscription.request.Data); err != nil {
+			fmt.Println(err)
+		}
+	}
+	s.Active.ReleaseClient(clientID)
+	s.Quotas.ReleaseClient(clientID)
+	s.Broker.CloseClient(clientID)
+	if s.Sessions != nil {
+		s.Sessions.Delete(clientID)
+	}
+}
+
+// handleConnectionInit runs the OnConnect hook, then answers with the client ID, issuing one if the request doesn't
+// have one, or has one the provider no longer accepts for the new session.
+// A client whose session has ended keeps the ID it sends only if the provider binds IDs to users and the ID is the new
+// session's user's. Otherwise the subscriptions of the ID it sends are ended, and it has to start them again
+func (s *Handler) handleConnectionInit(r *http.Request, p protocol.Protocol, req *protocol.Message, clientID string) *protocol.Response {
+	baseResponse := protocol.OKResponseFor(p)
+	var session context.Context
+	if s.OnConnect != nil {
+		var response *protocol.Response
+		session, response = s.connect(r, p, req)
+		if response != nil {
+			return response
+		}
+		// the client ID is issued and checked with the values of the new session
+		r = r.WithContext(sessions.WithSession(sessions.Detached(r.Context()), session))
+		if clientID != "" && s.ClientIDProvider != nil {
+			if _, err := s.ClientIDProvider.Resolve(r); err != nil {
+				s.releaseClient(clientID)
+				clientID = ""
+			}
+		}
+		if rc, ok := s.ClientIDProvider.(reclaimer); ok && clientID == "" {
+			presented, kept := rc.Reclaim(r)
+			if kept {
+				clientID = presented
+			} else if presented != "" {
+				s.releaseClient(presented)
+			}
+		}
+	}
+	if clientID == "" && s.ClientIDProvider != nil {
+		header := http.Header{}
+		issued, err := s.ClientIDProvider.Issue(r, header)
+		if err != nil {
+			fmt.Println(err)
+			return protocol.ServerErrorResponseFor(p)
+		}
+		for k := range header {
+			baseResponse.ExtraHeaders[k] = header.Get(k)
+		}
+		clientID = issued
+	}
+	if session != nil {
+		s.Sessions.Set(clientID, session)
+	}
+	baseResponse.ExtraHeaders[clientid.ClientIDHeader] = clientID
+	return baseResponse
+}
+
+// rateLimit takes a token from the limiter for the request, returning the response to send if there are none left
+func (s *Handler) rateLimit(limiter *ratelimit.Limiter, p protocol.Protocol, r *http.Request) *protocol.Response {
+	allowed, retryAfter := limiter.Allow(ratelimit.Key(r, s.RateLimitKey))
+	if !allowed {
+		return protocol.TooManyRequestsResponse(p, retryAfter)
+	}
+	return nil
+}
+
+// prepareGQLStart validates a start message and counts it against the quotas,
+// returning the subscription to store and whether it was counted, or the response if it is refused
+func (s *Handler) prepareGQLStart(ctx context.Context, p protocol.Protocol, req *protocol.Message, clientID string) (*subscriptions.Request, bool, *protocol.Response) {
 	if req.Payload == nil {
-		return protocol.BadRequestResponse()
+		return nil, false, protocol.BadRequestResponseFor(p)
 	}
 	var gqlPayload protocol.GQLStartPayload
-	err := json.Unmarshal(req.Payload.Bytes, &gqlPayload)
+	err := json.Unmarshal(req.Payload, &gqlPayload)
 	if err != nil {
 		fmt.Println(err)
-		return protocol.BadRequestResponse()
+		return nil, false, protocol.BadRequestResponseFor(p)
+	}
+	if resolveResponse := s.PersistedQueries.Resolve(p, &gqlPayload); resolveResponse != nil {
+		return nil, false, resolveResponse
 	}
-	validationResponse := protocol.ValidatePayload(gqlPayload, s.Broker.Schema)
+	parsed, validationResponse := protocol.ValidatePayloadFor(p, gqlPayload, s.Broker.Schema, s.Limits)
 	if validationResponse != nil {
-		return validationResponse
-	}
-	err = s.StorageAdapter.NotifyNewSubscription(ctx, subscriptions.Data{
-		SubscriptionID: req.ID,
-		ClientID:       clientID,
-	}, subscriptions.Query{
-		RequestString:  gqlPayload.Query,
-		VariableValues: gqlPayload.Variables,
-	})
+		return nil, false, validationResponse
+	}
+	request := &subscriptions.Request{
+		Data: subscriptions.Data{
+			SubscriptionID: req.ID,
+			ClientID:       clientID,
+		},
+		Query: subscriptions.Query{
+			RequestString:  gqlPayload.Query,
+			VariableValues: gqlPayload.Variables,
+			OperationName:  gqlPayload.OperationName,
+		},
+	}
+	if s.AuthorizeSubscription != nil {
+		err := s.AuthorizeSubscription(subscriptions.WithParsedQuery(ctx, parsed), request.Data, request.Query)
+		if err != nil {
+			return nil, false, protocol.ForbiddenResponse(p, err)
+		}
+	}
+	reserved, quotaResponse := s.Quotas.Acquire(ctx, p, clientID, req.ID)
+	if quotaResponse != nil {
+		return nil, false, quotaResponse
+	}
+	return request, reserved, nil
+}
+
+func (s *Handler) handleGQLStart(ctx context.Context, p protocol.Protocol, req *protocol.Message, clientID string) *protocol.Response {
+	request, reserved, response := s.prepareGQLStart(ctx, p, req, clientID)
+	if response != nil {
+		return response
+	}
+	err := s.StorageAdapter.NotifyNewSubscription(ctx, request.Data, request.Query)
+	if err != nil {
+		fmt.Println(err)
+		// a start reusing the ID of an active subscription mustn't release the slot that subscription holds
+		if reserved {
+			s.Quotas.Release(clientID, req.ID)
+		}
+		return protocol.BadRequestResponseFor(p)
+	}
+	s.Active.add(ctx, *request)
+	return protocol.OKResponseFor(p)
+}
+
+// decodeMessage decodes a single message, detecting its protocol if the handler doesn't have one
+func (s *Handler) decodeMessage(body []byte) (protocol.Protocol, *protocol.Message, *protocol.Response) {
+	p := s.Protocol
+	if p == nil {
+		var err error
+		p, err = protocol.DetectProtocol(body)
+		if err != nil {
+			fmt.Println(err)
+			return protocol.Legacy, nil, protocol.BadRequestResponseFor(protocol.Legacy)
+		}
+	}
+	req, err := p.Decode(body)
 	if err != nil {
 		fmt.Println(err)
-		return protocol.BadRequestResponse()
+		return p, nil, protocol.BadRequestResponseFor(p)
 	}
-	return protocol.OKResponse()
+	return p, req, nil
 }
 
 func (s *Handler) handlePayload(r *http.Request, clientID string) *protocol.Response {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return protocol.ServerErrorResponse()
+		return protocol.ServerErrorResponseFor(protocol.Legacy)
 	}
-	req, err := protocol.DecodePayload(body)
-	if err != nil {
-		fmt.Println(err)
-		return protocol.BadRequestResponse()
+	if isBatch(body) {
+		return s.handleBatch(r, clientID, body)
 	}
-	switch req.Type {
-	case "GQL_START":
-		response := s.handleGQLStart(r.Context(), req, clientID)
+	p, req, response := s.decodeMessage(body)
+	if response != nil {
+		return response
+	}
+	if response := s.requireInit(r, p, req, clientID); response != nil {
 		return response
-	case "GQL_STOP":
+	}
+	if req.Type == protocol.MessageStart {
+		if response := s.rateLimit(s.StartLimiter, p, r); response != nil {
+			return response
+		}
+		return s.handleGQLStart(r.Context(), p, req, clientID)
+	}
+	return s.handleMessage(r, p, req, clientID)
+}
+
+// handleMessage handles every message type apart from start messages
+func (s *Handler) handleMessage(r *http.Request, p protocol.Protocol, req *protocol.Message, clientID string) *protocol.Response {
+	switch req.Type {
+	case protocol.MessageStop:
+		if response := s.rateLimit(s.StopLimiter, p, r); response != nil {
+			return response
+		}
 		s.StorageAdapter.NotifyUnsubscribe(r.Context(), subscriptions.Data{
 			SubscriptionID: req.ID,
 			ClientID:       clientID,
 		})
-		return protocol.OKResponse()
-	case "GQL_CONNECTION_TERMINATE":
-		s.Broker.ClosingClients <- clientID
-		return protocol.OKResponse()
-	case "GQL_INIT":
-		baseResponse := protocol.OKResponse()
-		baseResponse.ExtraHeaders[clientid.ClientIDHeader] = clientid.GetClientIDFromRequest(r)
-		return baseResponse
+		s.Quotas.Release(clientID, req.ID)
+		s.Active.Release(clientID, req.ID)
+		return protocol.OKResponseFor(p)
+	case protocol.MessageConnectionTerminate:
+		s.Broker.CloseClient(clientID)
+		if s.Sessions != nil {
+			s.Sessions.Delete(clientID)
+		}
+		return protocol.OKResponseFor(p)
+	case protocol.MessageConnectionInit:
+		return s.handleConnectionInit(r, p, req, clientID)
+	case protocol.MessagePing:
+		return protocol.NewResponse(p, http.StatusOK, &protocol.Message{Type: protocol.MessagePong})
+	case protocol.MessagePong:
+		return protocol.OKResponseFor(p)
 	default:
-		return protocol.BadRequestResponse()
+		return protocol.BadRequestResponseFor(p)
 	}
 }
 
 func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	clientID := clientid.GetClientIDFromRequest(r)
+	if s.Sessions != nil {
+		r, _ = s.Sessions.Attach(r, clientID)
+	}
 	res := s.handlePayload(r, clientID)
 	for k, v := range res.ExtraHeaders {
 		w.Header().Set(k, v)
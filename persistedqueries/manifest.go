@@ -0,0 +1,50 @@
+package persistedqueries
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// ErrReadOnly is returned when adding a query to a Manifest
+var ErrReadOnly = errors.New("persisted query manifest is read only")
+
+// Manifest is a fixed set of queries, usually generated when the client is built. Use it with a strict Resolver
+// to only allow the subscriptions in the manifest.
+type Manifest struct {
+	queries map[string]string
+}
+
+// NewManifest creates a Manifest from the queries, which are hashed with Hash
+func NewManifest(queries []string) *Manifest {
+	manifest := &Manifest{queries: map[string]string{}}
+	for _, query := range queries {
+		manifest.queries[Hash(query)] = query
+	}
+	return manifest
+}
+
+// LoadManifest reads a Manifest from a JSON object of hashes to queries. It returns an error if a hash doesn't match its query
+func LoadManifest(r io.Reader) (*Manifest, error) {
+	var queries map[string]string
+	if err := json.NewDecoder(r).Decode(&queries); err != nil {
+		return nil, err
+	}
+	for hash, query := range queries {
+		if Hash(query) != hash {
+			return nil, &Error{Code: HashMismatchCode, Message: "Manifest hash " + hash + " does not match its query"}
+		}
+	}
+	return &Manifest{queries: queries}, nil
+}
+
+// Get returns the query with the hash
+func (m *Manifest) Get(hash string) (string, bool, error) {
+	query, ok := m.queries[hash]
+	return query, ok, nil
+}
+
+// Put always returns ErrReadOnly
+func (m *Manifest) Put(hash string, query string) error {
+	return ErrReadOnly
+}
@@ -0,0 +1,58 @@
+package persistedqueries
+
+import (
+	"container/list"
+	"sync"
+)
+
+type entry struct {
+	hash  string
+	query string
+}
+
+// MemoryStore keeps the most recently used queries in memory, evicting the least recently used one when it is full.
+// Evicted queries are sent again by clients after a PersistedQueryNotFound error, so the store can be small.
+type MemoryStore struct {
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+	mux     sync.Mutex
+}
+
+// NewMemoryStore creates a MemoryStore keeping at most size queries
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// Get returns the query with the hash, marking it as recently used
+func (m *MemoryStore) Get(hash string) (string, bool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	element, ok := m.entries[hash]
+	if !ok {
+		return "", false, nil
+	}
+	m.order.MoveToFront(element)
+	return element.Value.(*entry).query, true, nil
+}
+
+// Put adds a query, evicting the least recently used one if the store is full
+func (m *MemoryStore) Put(hash string, query string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if element, ok := m.entries[hash]; ok {
+		m.order.MoveToFront(element)
+		return nil
+	}
+	m.entries[hash] = m.order.PushFront(&entry{hash: hash, query: query})
+	for m.order.Len() > m.size {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*entry).hash)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Package persistedqueries implements Apollo's automatic persisted queries for subscriptions, where clients send the
+// sha256 hash of a query in extensions.persistedQuery.sha256Hash instead of the query itself.
+// If the hash isn't known the client is sent a PersistedQueryNotFound error, and should retry with both the hash and
+// the query, which is then stored. In strict mode only the hashes already in the Store are accepted, which
+// makes the Store an allowlist of the subscriptions clients can start.
+package persistedqueries
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// ExtensionName is the key of the persisted query in the extensions of a start payload
+const ExtensionName = "persistedQuery"
+
+// The error messages Apollo clients look for, and the codes set in the error extensions
+const (
+	NotFoundMessage     = "PersistedQueryNotFound"
+	NotSupportedMessage = "PersistedQueryNotSupported"
+
+	NotFoundCode     = "PERSISTED_QUERY_NOT_FOUND"
+	NotSupportedCode = "PERSISTED_QUERY_NOT_SUPPORTED"
+	HashMismatchCode = "PERSISTED_QUERY_HASH_MISMATCH"
+	RequiredCode     = "PERSISTED_QUERY_REQUIRED"
+)
+
+// Store keeps queries by the hex encoded sha256 hash of their text.
+// Get returns ok as false if there is no query with that hash.
+// Stores are called from several goroutines at once, so implementations must be safe for concurrent use.
+type Store interface {
+	Get(hash string) (query string, ok bool, err error)
+	Put(hash string, query string) error
+}
+
+// Error is returned when a persisted query can't be resolved. Code is one of the codes above
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Formatted returns the error in the shape it is sent to clients, with its code in the extensions
+func (e *Error) Formatted() gqlerrors.FormattedError {
+	formatted := gqlerrors.NewFormattedError(e.Message)
+	formatted.Extensions = map[string]interface{}{"code": e.Code}
+	return formatted
+}
+
+// Resolver fills in the query of start payloads that only carry a hash.
+// If Strict is true, payloads without a hash are refused, and new queries are never added to the Store
+type Resolver struct {
+	Store  Store
+	Strict bool
+}
+
+// Hash returns the hex encoded sha256 hash of a query
+func Hash(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestedHash returns the hash in the payload's persisted query extension, or an empty string if there isn't one
+func requestedHash(payload *protocol.GQLStartPayload) string {
+	extension, ok := payload.Extensions[ExtensionName].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	hash, _ := extension["sha256Hash"].(string)
+	return hash
+}
+
+// Resolve sets the query of a payload that only carries a hash, and stores the query of one that carries both.
+// It returns the response to send if the payload can't be resolved.
+// A nil Resolver refuses any payload with a persisted query extension, as Apollo servers without support for them do.
+func (r *Resolver) Resolve(p protocol.Protocol, payload *protocol.GQLStartPayload) *protocol.Response {
+	err := r.resolve(payload)
+	if err == nil {
+		return nil
+	}
+	if resolveErr, ok := err.(*Error); ok {
+		return protocol.ValidationErrorResponse(p, []gqlerrors.FormattedError{resolveErr.Formatted()})
+	}
+	fmt.Println(err)
+	return protocol.ServerErrorResponseFor(p)
+}
+
+// resolve does the work of Resolve. Errors other than *Error come from the Store
+func (r *Resolver) resolve(payload *protocol.GQLStartPayload) error {
+	hash := requestedHash(payload)
+	if r == nil {
+		if hash != "" {
+			return &Error{Code: NotSupportedCode, Message: NotSupportedMessage}
+		}
+		return nil
+	}
+	if hash == "" {
+		if r.Strict {
+			return &Error{Code: RequiredCode, Message: "Only persisted queries can be started"}
+		}
+		return nil
+	}
+	if payload.Query != "" && Hash(payload.Query) != hash {
+		return &Error{Code: HashMismatchCode, Message: "Provided sha256Hash does not match query"}
+	}
+	query, ok, err := r.Store.Get(hash)
+	if err != nil {
+		return err
+	}
+	if ok {
+		payload.Query = query
+		return nil
+	}
+	if payload.Query == "" || r.Strict {
+		return &Error{Code: NotFoundCode, Message: NotFoundMessage}
+	}
+	return r.Store.Put(hash, payload.Query)
+}
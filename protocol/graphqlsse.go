@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// The graphql-sse event names, sent in the SSE event field rather than in the message itself
+const (
+	GraphQLSSENext     = "next"
+	GraphQLSSEComplete = "complete"
+)
+
+// GraphQLSSETokenHeader and GraphQLSSETokenQueryString carry the stream token in single connection mode
+const (
+	GraphQLSSETokenHeader      = "X-GraphQL-Event-Stream-Token"
+	GraphQLSSETokenQueryString = "token"
+)
+
+// GraphQLSSEOperationIDQueryString names the operation to stop in a single connection mode DELETE request
+const GraphQLSSEOperationIDQueryString = "operationId"
+
+type graphQLSSE struct {
+	singleConnection bool
+}
+
+// singleConnectionEvent is the data of a single connection mode event, tagged with the operation it belongs to
+type singleConnectionEvent struct {
+	ID      string          `json:"id"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// GraphQLSSE is the "distinct connections" mode of the protocol from https://github.com/enisdenjo/graphql-sse/blob/master/PROTOCOL.md.
+// A request body is a single GQLStartPayload, results are sent as the bare execution result,
+// and errors as {"errors":[...]}. It's never detected from a message, as the request has no type.
+var GraphQLSSE Protocol = graphQLSSE{}
+
+// GraphQLSSESingleConnection is the "single connection" mode of graphql-sse, where every operation shares a stream.
+// Results are sent as {"id":"<operationId>","payload":<execution result>}, errors in an operation as
+// {"id":"<operationId>","payload":{"errors":[...]}}, and completions as {"id":"<operationId>"}.
+// The operation id is set in the request's extensions.operationId
+var GraphQLSSESingleConnection Protocol = graphQLSSE{singleConnection: true}
+
+func (p graphQLSSE) Name() string {
+	if p.singleConnection {
+		return "graphql-sse-single-connection"
+	}
+	return "graphql-sse"
+}
+
+func (graphQLSSE) Recognises(messageType string) bool {
+	return false
+}
+
+func (graphQLSSE) TypeName(messageType MessageType) (string, bool) {
+	switch messageType {
+	case MessageData:
+		return GraphQLSSENext, true
+	case MessageComplete:
+		return GraphQLSSEComplete, true
+	case MessageError:
+		return GraphQLSSENext, true
+	default:
+		return "", false
+	}
+}
+
+func (graphQLSSE) Decode(body []byte) (*Message, error) {
+	var payload GQLStartPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	return &Message{
+		Type:    MessageStart,
+		Payload: body,
+	}, nil
+}
+
+func (p graphQLSSE) Encode(message *Message) ([]byte, error) {
+	switch message.Type {
+	case MessageError:
+		errors, err := json.Marshal(map[string][]gqlerrors.FormattedError{"errors": message.Errors})
+		if err != nil || !p.singleConnection || message.ID == "" {
+			return errors, err
+		}
+		return json.Marshal(singleConnectionEvent{ID: message.ID, Payload: errors})
+	case MessageData:
+		if p.singleConnection {
+			return json.Marshal(singleConnectionEvent{ID: message.ID, Payload: message.Payload})
+		}
+		return message.Payload, nil
+	case MessageComplete:
+		if p.singleConnection {
+			return json.Marshal(singleConnectionEvent{ID: message.ID})
+		}
+		return []byte{}, nil
+	default:
+		return nil, fmt.Errorf("graphql-sse has no equivalent of %q", message.Type)
+	}
+}
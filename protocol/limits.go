@@ -0,0 +1,194 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// Limits bounds the size of the subscriptions clients can start, as they are executed again for every event.
+// A zero value means that limit isn't enforced.
+// MaxDepth is the deepest nesting of fields, MaxComplexity the total cost of all the fields, and MaxAliases the number
+// of aliased fields. FieldCost returns the cost of a field on a type, if it is nil every field costs 1
+type Limits struct {
+	MaxDepth      int
+	MaxComplexity int
+	MaxAliases    int
+	FieldCost     func(typeName string, fieldName string) int
+}
+
+// The error codes set in the extensions of the errors returned when a limit is exceeded
+const (
+	MaxDepthExceeded      = "MAX_DEPTH_EXCEEDED"
+	MaxComplexityExceeded = "MAX_COMPLEXITY_EXCEEDED"
+	MaxAliasesExceeded    = "MAX_ALIASES_EXCEEDED"
+)
+
+// operationSize is what the Limits are checked against
+type operationSize struct {
+	depth      int
+	complexity int
+	aliases    int
+}
+
+// plus returns the size of two selections next to each other
+func (s operationSize) plus(other operationSize) operationSize {
+	if other.depth > s.depth {
+		s.depth = other.depth
+	}
+	s.complexity += other.complexity
+	s.aliases += other.aliases
+	return s
+}
+
+// sizeWalker measures an operation, following fragment spreads into their definitions.
+// Each fragment is measured once, and its size reused at every spread of it.
+// Documents with fragment cycles are rejected by validation before they get here
+type sizeWalker struct {
+	schema        *graphql.Schema
+	limits        Limits
+	fragments     map[string]*ast.FragmentDefinition
+	fragmentSizes map[string]operationSize
+	exceeded      bool
+}
+
+func (l Limits) enabled() bool {
+	return l.MaxDepth > 0 || l.MaxComplexity > 0 || l.MaxAliases > 0
+}
+
+// exceededBy reports whether the size is over any of the limits
+func (l Limits) exceededBy(size operationSize) bool {
+	return (l.MaxDepth > 0 && size.depth > l.MaxDepth) ||
+		(l.MaxComplexity > 0 && size.complexity > l.MaxComplexity) ||
+		(l.MaxAliases > 0 && size.aliases > l.MaxAliases)
+}
+
+func (l Limits) cost(typeName string, fieldName string) int {
+	if l.FieldCost == nil {
+		return 1
+	}
+	return l.FieldCost(typeName, fieldName)
+}
+
+// fieldType returns the named type of a field on parent, or nil if parent has no fields or no field with that name
+func fieldType(parent graphql.Type, fieldName string) graphql.Type {
+	var fields graphql.FieldDefinitionMap
+	switch t := parent.(type) {
+	case *graphql.Object:
+		fields = t.Fields()
+	case *graphql.Interface:
+		fields = t.Fields()
+	default:
+		return nil
+	}
+	field, ok := fields[fieldName]
+	if !ok {
+		return nil
+	}
+	named, _ := graphql.GetNamed(field.Type).(graphql.Type)
+	return named
+}
+
+// walk returns the size of a selection set, with its depth counted from its own fields.
+// It stops as soon as a limit is exceeded, as sizes only grow, so the size is then a lower bound
+func (w *sizeWalker) walk(selectionSet *ast.SelectionSet, parent graphql.Type) operationSize {
+	var size operationSize
+	if selectionSet == nil {
+		return size
+	}
+	for _, selection := range selectionSet.Selections {
+		if w.exceeded {
+			return size
+		}
+		var selected operationSize
+		switch s := selection.(type) {
+		case *ast.Field:
+			selected = w.walk(s.SelectionSet, fieldType(parent, s.Name.Value))
+			selected.depth++
+			typeName := ""
+			if parent != nil {
+				typeName = parent.Name()
+			}
+			selected.complexity += w.limits.cost(typeName, s.Name.Value)
+			if s.Alias != nil {
+				selected.aliases++
+			}
+		case *ast.InlineFragment:
+			fragmentType := parent
+			if s.TypeCondition != nil {
+				fragmentType = w.schema.Type(s.TypeCondition.Name.Value)
+			}
+			selected = w.walk(s.SelectionSet, fragmentType)
+		case *ast.FragmentSpread:
+			selected = w.fragmentSize(s.Name.Value)
+		}
+		size = size.plus(selected)
+		w.exceeded = w.limits.exceededBy(size)
+	}
+	return size
+}
+
+// fragmentSize returns the size of the named fragment, measuring it the first time it is spread
+func (w *sizeWalker) fragmentSize(name string) operationSize {
+	if size, ok := w.fragmentSizes[name]; ok {
+		return size
+	}
+	fragment, ok := w.fragments[name]
+	if !ok {
+		return operationSize{}
+	}
+	size := w.walk(fragment.SelectionSet, w.schema.Type(fragment.TypeCondition.Name.Value))
+	w.fragmentSizes[name] = size
+	return size
+}
+
+func limitError(code string, message string, limit int, actual int) gqlerrors.FormattedError {
+	formatted := gqlerrors.NewFormattedError(message)
+	formatted.Extensions = map[string]interface{}{
+		"code":   code,
+		"limit":  limit,
+		"actual": actual,
+	}
+	return formatted
+}
+
+// check measures the operation, and returns an error for each limit it exceeds.
+// The actual size in the errors is a lower bound, as measuring stops at the first limit exceeded
+func (l Limits) check(document *ast.Document, operation *ast.OperationDefinition, schema *graphql.Schema) []gqlerrors.FormattedError {
+	if !l.enabled() {
+		return nil
+	}
+	walker := &sizeWalker{
+		schema:        schema,
+		limits:        l,
+		fragments:     map[string]*ast.FragmentDefinition{},
+		fragmentSizes: map[string]operationSize{},
+	}
+	for _, definition := range document.Definitions {
+		if fragment, ok := definition.(*ast.FragmentDefinition); ok {
+			walker.fragments[fragment.Name.Value] = fragment
+		}
+	}
+	var root graphql.Type
+	if subscriptionType := schema.SubscriptionType(); subscriptionType != nil {
+		root = subscriptionType
+	}
+	size := walker.walk(operation.SelectionSet, root)
+
+	var errs []gqlerrors.FormattedError
+	if l.MaxDepth > 0 && size.depth > l.MaxDepth {
+		errs = append(errs, limitError(MaxDepthExceeded,
+			fmt.Sprintf("Subscription depth %d exceeds the maximum of %d", size.depth, l.MaxDepth), l.MaxDepth, size.depth))
+	}
+	if l.MaxComplexity > 0 && size.complexity > l.MaxComplexity {
+		errs = append(errs, limitError(MaxComplexityExceeded,
+			fmt.Sprintf("Subscription complexity %d exceeds the maximum of %d", size.complexity, l.MaxComplexity), l.MaxComplexity, size.complexity))
+	}
+	if l.MaxAliases > 0 && size.aliases > l.MaxAliases {
+		errs = append(errs, limitError(MaxAliasesExceeded,
+			fmt.Sprintf("Subscription uses %d aliases, more than the maximum of %d", size.aliases, l.MaxAliases), l.MaxAliases, size.aliases))
+	}
+	return errs
+}
@@ -1,18 +1,37 @@
 // Package protocol is an implementation of https://github.com/apollographql/subscriptions-transport-ws/blob/master/PROTOCOL.md
-// based on the work by eientei on https://github.com/eientei/wsgraphql
+// based on the work by eientei on https://github.com/eientei/wsgraphql, alongside the newer graphql-transport-ws message set
+// from https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md. Both are implementations of Protocol, which
+// translates the protocol independent MessageType to and from each protocol's own type names.
+// The rest of this comment describes the Legacy protocol, TransportWS maps each of these to its lowercase equivalent.
 // GQL_INIT, GQL_START, GQL_STOP, GQL_CONNECTION_TERMINATE will be sent to the subscription endpoint,
 // and GQL_ERROR will be returned synchronously in case of an error, otherwise a 200 with {"type":"GQL_CONNECTION_ACK"} will be returned.
 // GQL_COMPLETE, GQL_KEEPALIVE and GQL_DATA will be sent over the streaming endpoint.
+// GQL_DATA and GQL_COMPLETE are sent with an SSE id, and on reconnect any frames after the Last-Event-ID will be replayed.
+// If some of those frames are no longer available, GQL_EVENTS_MISSED will be sent first.
+// GQL_CONNECTION_TERMINATE is sent over the streaming endpoint when a stream is replaced by a newer one from the same client.
+// GQL_CONNECTION_ERROR is sent over the streaming endpoint before a stream is closed for falling too far behind.
+// GQL_SERVER_SHUTDOWN is sent with an SSE retry hint before a stream is closed because the server is shutting down.
+// GQL_CREDENTIALS_EXPIRED is sent before a stream is closed because the credentials it was opened with have expired.
+// GQL_ERROR is sent over the streaming endpoint, with the subscription's id, when a subscription is revoked.
+// Errors are sent as {"type":"GQL_ERROR","payload":{"errors":[...]}} over the streaming endpoint and when a start
+// message fails validation. Other errors returned synchronously keep the top level {"type":"GQL_ERROR","errors":[...]}.
 // GQL_INIT will respond with the ClientIDHeader, defined in the clientid package, as well as a cookie.
+// Its payload is passed to the connect hook, if the handlers have one, and GQL_ERROR is returned if the hook rejects it.
 package protocol
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/NickBlow/gqlssehandlers/subscriptions"
 	"github.com/graphql-go/graphql"
 	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
 	"github.com/graphql-go/graphql/language/parser"
 )
 
@@ -36,11 +55,62 @@ const (
 	GQLConnectionAck       = "GQL_CONNECTION_ACK"
 	GQLData                = "GQL_DATA"
 	GQLError               = "GQL_ERROR"
+	GQLConnectionError     = "GQL_CONNECTION_ERROR"
 	GQLComplete            = "GQL_COMPLETE"
 	GQLConnectionKeepAlive = "GQL_KEEPALIVE"
+	GQLEventsMissed        = "GQL_EVENTS_MISSED"
+	GQLServerShutdown      = "GQL_SERVER_SHUTDOWN"
+	GQLCredentialsExpired  = "GQL_CREDENTIALS_EXPIRED"
 )
 
-// GQLOverWebsocketProtocol is the wrapper for the protocol
+// MessageType is the protocol independent type of a message. Each Protocol maps it to and from its own type names
+type MessageType string
+
+// The message types understood by the handlers
+const (
+	// MessageUnknown is the type of messages the protocol doesn't recognise
+	MessageUnknown MessageType = ""
+
+	// Client to Server types
+
+	MessageConnectionInit      MessageType = "connection_init"
+	MessageStart               MessageType = "start"
+	MessageStop                MessageType = "stop"
+	MessageConnectionTerminate MessageType = "connection_terminate"
+	MessagePing                MessageType = "ping"
+
+	// Server to Client
+
+	MessageConnectionAck MessageType = "connection_ack"
+	MessageData          MessageType = "data"
+	MessageError         MessageType = "error"
+	MessageComplete      MessageType = "complete"
+	MessageKeepAlive     MessageType = "keepalive"
+	MessagePong          MessageType = "pong"
+	// MessageEventsMissed is sent on reconnect when some events after the Last-Event-ID are no longer available for replay
+	MessageEventsMissed MessageType = "events_missed"
+	// MessageConnectionError is sent before a stream is closed for falling too far behind
+	MessageConnectionError MessageType = "connection_error"
+	// MessageServerShutdown is the last message sent before the server closes a stream because it is shutting down.
+	// It carries an SSE retry hint, and clients should reconnect with their Last-Event-ID
+	MessageServerShutdown MessageType = "server_shutdown"
+	// MessageCredentialsExpired is the last message sent before a stream is closed because the credentials it was
+	// opened with have expired. Clients should authenticate again before reconnecting
+	MessageCredentialsExpired MessageType = "credentials_expired"
+)
+
+// Message is a protocol independent message. Errors, if set, are sent in the payload in the shape the protocol expects
+type Message struct {
+	Type    MessageType
+	ID      string
+	Payload json.RawMessage
+	Errors  []gqlerrors.FormattedError
+}
+
+// LastEventIDHeader is the header sent by EventSource on reconnect, containing the id of the last event it received
+const LastEventIDHeader = "Last-Event-ID"
+
+// GQLOverWebsocketProtocol is the wrapper for the protocol, both Legacy and TransportWS messages use it
 type GQLOverWebsocketProtocol struct {
 	Payload *PayloadBytes `json:"payload,omitempty"`
 	Type    string        `json:"type"`
@@ -64,15 +134,23 @@ func (payload *PayloadBytes) MarshalJSON() ([]byte, error) {
 	return json.Marshal(payload.Value)
 }
 
+// DecodePayload decodes the request body as GQLOverWebsocketProtocol, without translating its type.
+//
+// Deprecated: use Protocol.Decode, or DetectProtocol to find the protocol first
+func DecodePayload(body []byte) (*GQLOverWebsocketProtocol, error) {
+	var req GQLOverWebsocketProtocol
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
 // GQLStartPayload represents the data sent on a GQL start message
 type GQLStartPayload struct {
 	Query         string                 `json:"query"`
 	OperationName string                 `json:"operationName,omitempty"`
 	Variables     map[string]interface{} `json:"variables,omitempty"`
-}
-
-type gqlValidationError struct {
-	Errors []gqlerrors.FormattedError `json:"errors"`
+	Extensions    map[string]interface{} `json:"extensions,omitempty"`
 }
 
 // Response is a thin wrapper around HTTP status code & body
@@ -82,73 +160,220 @@ type Response struct {
 	StatusCode   int
 }
 
-// OKResponse returns a default ACK response, using GQLConnectionAck
-func OKResponse() *Response {
+// NewResponse encodes the message with the protocol. If that fails it returns a generic server error
+func NewResponse(p Protocol, statusCode int, message *Message) *Response {
+	encoded, err := p.Encode(message)
+	if err != nil {
+		fmt.Println("error while encoding response")
+		fmt.Println(err)
+		return &Response{
+			ExtraHeaders: map[string]string{},
+			Message:      []byte(`{"errors":[{"message": "Something went wrong"}]}`),
+			StatusCode:   http.StatusInternalServerError,
+		}
+	}
 	return &Response{
 		ExtraHeaders: map[string]string{},
-		Message:      []byte(`{"type":"` + GQLConnectionAck + `"}`),
-		StatusCode:   http.StatusOK,
+		Message:      encoded,
+		StatusCode:   statusCode,
 	}
 }
 
-// ServerErrorResponse returns a default Server error response
-func ServerErrorResponse() *Response {
+// legacyErrorBody is the body of the Legacy protocol's synchronous error responses, which carry their errors
+// at the top level rather than in the payload
+type legacyErrorBody struct {
+	Type   string                     `json:"type"`
+	Errors []gqlerrors.FormattedError `json:"errors"`
+}
+
+// ErrorResponse returns a synchronous error response with the errors. The Legacy protocol answers with
+// {"type":"GQL_ERROR","errors":[...]}, and the other protocols put the errors in the payload
+func ErrorResponse(p Protocol, statusCode int, errors ...gqlerrors.FormattedError) *Response {
+	if p != Legacy {
+		return NewResponse(p, statusCode, &Message{
+			Type:   MessageError,
+			Errors: errors,
+		})
+	}
+	encoded, err := json.Marshal(legacyErrorBody{Type: GQLError, Errors: errors})
+	if err != nil {
+		fmt.Println("error while encoding response")
+		fmt.Println(err)
+		return errorResponse(p, http.StatusInternalServerError, "Something went wrong")
+	}
 	return &Response{
-		Message:    []byte(`{"type":"` + GQLError + `", "errors":[{"message": "Something went wrong"}]}`),
-		StatusCode: http.StatusInternalServerError,
+		ExtraHeaders: map[string]string{},
+		Message:      encoded,
+		StatusCode:   statusCode,
 	}
 }
 
-// BadRequestResponse returns a default Bad Error response
+func errorResponse(p Protocol, statusCode int, message string) *Response {
+	return ErrorResponse(p, statusCode, gqlerrors.NewFormattedError(message))
+}
+
+// OKResponse returns a default ACK response, encoded with the Legacy protocol
+func OKResponse() *Response {
+	return OKResponseFor(Legacy)
+}
+
+// OKResponseFor returns a default ACK response, using MessageConnectionAck
+func OKResponseFor(p Protocol) *Response {
+	return NewResponse(p, http.StatusOK, &Message{Type: MessageConnectionAck})
+}
+
+// ServerErrorResponse returns a default Server error response, encoded with the Legacy protocol
+func ServerErrorResponse() *Response {
+	return ServerErrorResponseFor(Legacy)
+}
+
+// ServerErrorResponseFor returns a default Server error response
+func ServerErrorResponseFor(p Protocol) *Response {
+	return errorResponse(p, http.StatusInternalServerError, "Something went wrong")
+}
+
+// BadRequestResponse returns a default Bad Error response, encoded with the Legacy protocol
 func BadRequestResponse() *Response {
-	return &Response{
-		Message:    []byte(`{"type":"` + GQLError + `", "errors":[{"message": "Please send a valid payload"}]}`),
-		StatusCode: http.StatusBadRequest,
-	}
+	return BadRequestResponseFor(Legacy)
 }
 
-// DecodePayload decodes the request body as GQLOverWebsocketProtocol
-func DecodePayload(body []byte) (*GQLOverWebsocketProtocol, error) {
-	var req GQLOverWebsocketProtocol
-	err := json.Unmarshal(body, &req)
-	fmt.Println(string(body))
-	if err != nil {
-		return nil, err
-	}
-	return &req, nil
+// BadRequestResponseFor returns a default Bad Error response
+func BadRequestResponseFor(p Protocol) *Response {
+	return errorResponse(p, http.StatusBadRequest, "Please send a valid payload")
+}
+
+// ConflictResponse returns the response for a stream that was refused because the client already has one open, encoded with the Legacy protocol
+func ConflictResponse() *Response {
+	return ConflictResponseFor(Legacy)
+}
+
+// ConflictResponseFor returns the response for a stream that was refused because the client already has one open
+func ConflictResponseFor(p Protocol) *Response {
+	return errorResponse(p, http.StatusConflict, "Client already has an open stream")
+}
+
+// NotFoundResponse returns the response for a request naming a stream that doesn't exist
+func NotFoundResponse(p Protocol) *Response {
+	return errorResponse(p, http.StatusNotFound, "Stream not found")
+}
+
+// UnauthorizedResponse returns the response for a request that must be preceded by a GQL_INIT,
+// either to be issued a client ID or to be authenticated
+func UnauthorizedResponse(p Protocol) *Response {
+	return errorResponse(p, http.StatusUnauthorized, "Send a connection init message first")
+}
+
+// Forbidden is the error code set in the extensions of the error returned by ForbiddenResponse
+const Forbidden = "FORBIDDEN"
+
+// ForbiddenResponse returns the response for a subscription the client isn't allowed to start, with the reason why
+func ForbiddenResponse(p Protocol, reason error) *Response {
+	formatted := gqlerrors.NewFormattedError(reason.Error())
+	formatted.Extensions = map[string]interface{}{"code": Forbidden}
+	return ErrorResponse(p, http.StatusForbidden, formatted)
+}
+
+// ConnectionRejected is the error code set in the extensions of the error returned by ConnectionRejectedResponse
+const ConnectionRejected = "CONNECTION_REJECTED"
+
+// ConnectionRejectedResponse returns the response for a GQL_INIT that was rejected, with the reason it was rejected
+func ConnectionRejectedResponse(p Protocol, reason error) *Response {
+	formatted := gqlerrors.NewFormattedError(reason.Error())
+	formatted.Extensions = map[string]interface{}{"code": ConnectionRejected}
+	return ErrorResponse(p, http.StatusUnauthorized, formatted)
 }
 
-//KeepAlivePayload is a pre-marshalled JSON string representing the keepalive
-const KeepAlivePayload = `{"type":"` + GQLConnectionKeepAlive + `"}`
+// ShuttingDownResponse returns the response for a stream that was refused because the server is shutting down, encoded with the Legacy protocol
+func ShuttingDownResponse() *Response {
+	return ShuttingDownResponseFor(Legacy)
+}
 
-func validationErrorResponse(errors []gqlerrors.FormattedError) *Response {
-	val, err := json.Marshal(GQLOverWebsocketProtocol{
-		Type:    GQLError,
-		Payload: &PayloadBytes{Value: gqlValidationError{Errors: errors}},
+// ShuttingDownResponseFor returns the response for a stream that was refused because the server is shutting down
+func ShuttingDownResponseFor(p Protocol) *Response {
+	return errorResponse(p, http.StatusServiceUnavailable, "Server is shutting down")
+}
+
+// TooManyRequestsResponse returns the response for a request that was refused by a rate limit,
+// with a Retry-After header of the whole number of seconds until it would be allowed
+func TooManyRequestsResponse(p Protocol, retryAfter time.Duration) *Response {
+	formatted := gqlerrors.NewFormattedError("Too many requests, please retry later")
+	formatted.Extensions = map[string]interface{}{"code": RateLimited}
+	res := ErrorResponse(p, http.StatusTooManyRequests, formatted)
+	res.ExtraHeaders["Retry-After"] = strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+	return res
+}
+
+// RateLimited is the error code set in the extensions of the error returned by TooManyRequestsResponse
+const RateLimited = "RATE_LIMITED"
+
+// ValidationErrorResponse returns the response for a start message that was refused with the errors
+func ValidationErrorResponse(p Protocol, errors []gqlerrors.FormattedError) *Response {
+	return NewResponse(p, http.StatusBadRequest, &Message{
+		Type:   MessageError,
+		Errors: errors,
 	})
-	if err != nil {
-		fmt.Println("error while marshalling validation errors")
-		fmt.Println(err)
-		return ServerErrorResponse()
+}
+
+// selectOperation returns the operation named by operationName, or the only operation in the document if it is empty
+func selectOperation(document *ast.Document, operationName string) (*ast.OperationDefinition, error) {
+	var selected *ast.OperationDefinition
+	for _, definition := range document.Definitions {
+		operation, ok := definition.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if operationName == "" {
+			if selected != nil {
+				return nil, errors.New("Must provide operation name if query contains multiple operations")
+			}
+			selected = operation
+			continue
+		}
+		if operation.Name != nil && operation.Name.Value == operationName {
+			return operation, nil
+		}
 	}
-	return &Response{
-		StatusCode: 400,
-		Message:    val,
+	if selected == nil {
+		if operationName != "" {
+			return nil, fmt.Errorf("Unknown operation named %q", operationName)
+		}
+		return nil, errors.New("Must provide an operation")
 	}
+	return selected, nil
 }
 
-// ValidatePayload validates a graphql payload without executing it
+// ValidatePayload validates a graphql payload without executing it, answering with the Legacy protocol.
+// It doesn't enforce any Limits, use ValidatePayloadFor for those
 func ValidatePayload(gqlPayload GQLStartPayload, schema *graphql.Schema) *Response {
+	_, response := ValidatePayloadFor(Legacy, gqlPayload, schema, Limits{})
+	return response
+}
+
+// ValidatePayloadFor validates a graphql payload without executing it.
+// The operation chosen by OperationName, or the only operation in the document, must be a subscription,
+// and it must be within the limits. It returns the parsed query if it is valid, or the response to send if not
+func ValidatePayloadFor(p Protocol, gqlPayload GQLStartPayload, schema *graphql.Schema, limits Limits) (*subscriptions.ParsedQuery, *Response) {
 	// validate without executing - ignoring extensions for now
 	AST, err := parser.Parse(parser.ParseParams{Source: gqlPayload.Query})
 
 	if err != nil {
 		formatted := gqlerrors.FormatErrors(err)
-		return validationErrorResponse(formatted)
+		return nil, ValidationErrorResponse(p, formatted)
 	}
 	validationResult := graphql.ValidateDocument(schema, AST, nil)
 	if !validationResult.IsValid {
-		return validationErrorResponse(validationResult.Errors)
+		return nil, ValidationErrorResponse(p, validationResult.Errors)
 	}
-	return nil
+	operation, err := selectOperation(AST, gqlPayload.OperationName)
+	if err != nil {
+		return nil, ValidationErrorResponse(p, gqlerrors.FormatErrors(err))
+	}
+	if operation.Operation != ast.OperationTypeSubscription {
+		err := fmt.Errorf("Only subscription operations can be started, got a %v", operation.Operation)
+		return nil, ValidationErrorResponse(p, gqlerrors.FormatErrors(err))
+	}
+	if limitErrors := limits.check(AST, operation, schema); len(limitErrors) > 0 {
+		return nil, ValidationErrorResponse(p, limitErrors)
+	}
+	return &subscriptions.ParsedQuery{Document: AST, Operation: operation}, nil
 }
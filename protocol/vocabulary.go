@@ -0,0 +1,190 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// Protocol translates between the protocol independent messages used by the handlers and a protocol's wire format
+type Protocol interface {
+	// Name identifies the protocol, e.g. in the ProtocolQueryString
+	Name() string
+	// Recognises reports whether the type is one the protocol's clients send
+	Recognises(messageType string) bool
+	// Decode decodes a message sent by a client. Types the protocol doesn't know are decoded as MessageUnknown
+	Decode(body []byte) (*Message, error)
+	// Encode encodes a message sent by the server, returning an error if the protocol has no equivalent type
+	Encode(message *Message) ([]byte, error)
+	// TypeName returns the protocol's own name for a message type the server sends, and false if it has none
+	TypeName(messageType MessageType) (string, bool)
+}
+
+// ProtocolQueryString can be set on the streaming endpoint to the Name of the protocol the stream should be encoded with,
+// when the handlers aren't configured with a single protocol
+const ProtocolQueryString = "protocol"
+
+// The graphql-transport-ws type names. connection_terminate, events_missed, connection_error, server_shutdown
+// and credentials_expired are extensions needed over SSE, where there is no socket to close.
+const (
+	TransportWSConnectionInit      = "connection_init"
+	TransportWSConnectionAck       = "connection_ack"
+	TransportWSPing                = "ping"
+	TransportWSPong                = "pong"
+	TransportWSSubscribe           = "subscribe"
+	TransportWSNext                = "next"
+	TransportWSError               = "error"
+	TransportWSComplete            = "complete"
+	TransportWSConnectionTerminate = "connection_terminate"
+	TransportWSEventsMissed        = "events_missed"
+	TransportWSConnectionError     = "connection_error"
+	TransportWSServerShutdown      = "server_shutdown"
+	TransportWSCredentialsExpired  = "credentials_expired"
+)
+
+// vocabulary is a Protocol that only differs from the others in its type names and the shape of its error payload
+type vocabulary struct {
+	name         string
+	clientTypes  map[string]MessageType
+	serverTypes  map[MessageType]string
+	errorPayload func(errors []gqlerrors.FormattedError) interface{}
+}
+
+// Legacy is the subscriptions-transport-ws protocol, with its GQL_* types
+var Legacy Protocol = &vocabulary{
+	name: "subscriptions-transport-ws",
+	clientTypes: map[string]MessageType{
+		GQLConnectionInit:      MessageConnectionInit,
+		GQLStart:               MessageStart,
+		GQLStop:                MessageStop,
+		GQLConnectionTerminate: MessageConnectionTerminate,
+	},
+	serverTypes: map[MessageType]string{
+		MessageConnectionAck:       GQLConnectionAck,
+		MessageData:                GQLData,
+		MessageError:               GQLError,
+		MessageComplete:            GQLComplete,
+		MessageKeepAlive:           GQLConnectionKeepAlive,
+		MessageEventsMissed:        GQLEventsMissed,
+		MessageConnectionError:     GQLConnectionError,
+		MessageServerShutdown:      GQLServerShutdown,
+		MessageCredentialsExpired:  GQLCredentialsExpired,
+		MessageConnectionTerminate: GQLConnectionTerminate,
+	},
+	errorPayload: func(errors []gqlerrors.FormattedError) interface{} {
+		return map[string][]gqlerrors.FormattedError{"errors": errors}
+	},
+}
+
+// TransportWS is the graphql-transport-ws protocol used by graphql-ws, urql and newer Apollo clients.
+// Keepalives are sent as unsolicited pongs
+var TransportWS Protocol = &vocabulary{
+	name: "graphql-transport-ws",
+	clientTypes: map[string]MessageType{
+		TransportWSConnectionInit:      MessageConnectionInit,
+		TransportWSSubscribe:           MessageStart,
+		TransportWSComplete:            MessageStop,
+		TransportWSConnectionTerminate: MessageConnectionTerminate,
+		TransportWSPing:                MessagePing,
+		TransportWSPong:                MessagePong,
+	},
+	serverTypes: map[MessageType]string{
+		MessageConnectionAck:       TransportWSConnectionAck,
+		MessageData:                TransportWSNext,
+		MessageError:               TransportWSError,
+		MessageComplete:            TransportWSComplete,
+		MessageKeepAlive:           TransportWSPong,
+		MessagePong:                TransportWSPong,
+		MessageEventsMissed:        TransportWSEventsMissed,
+		MessageConnectionError:     TransportWSConnectionError,
+		MessageServerShutdown:      TransportWSServerShutdown,
+		MessageCredentialsExpired:  TransportWSCredentialsExpired,
+		MessageConnectionTerminate: TransportWSConnectionTerminate,
+	},
+	errorPayload: func(errors []gqlerrors.FormattedError) interface{} {
+		return errors
+	},
+}
+
+// Protocols are the protocols that can be detected, in the order they are tried
+var Protocols = []Protocol{Legacy, TransportWS}
+
+// ProtocolByName returns the protocol with the given name, or nil if there isn't one
+func ProtocolByName(name string) Protocol {
+	for _, p := range Protocols {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// DetectProtocol returns the protocol the message belongs to, based on its type
+func DetectProtocol(body []byte) (Protocol, error) {
+	var envelope GQLOverWebsocketProtocol
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	for _, p := range Protocols {
+		if p.Recognises(envelope.Type) {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown message type %q", envelope.Type)
+}
+
+// ProtocolFromRequest returns the protocol named in the request's ProtocolQueryString, defaulting to Legacy
+func ProtocolFromRequest(r *http.Request) Protocol {
+	if p := ProtocolByName(r.URL.Query().Get(ProtocolQueryString)); p != nil {
+		return p
+	}
+	return Legacy
+}
+
+func (v *vocabulary) Name() string {
+	return v.name
+}
+
+func (v *vocabulary) TypeName(messageType MessageType) (string, bool) {
+	name, ok := v.serverTypes[messageType]
+	return name, ok
+}
+
+func (v *vocabulary) Recognises(messageType string) bool {
+	_, ok := v.clientTypes[messageType]
+	return ok
+}
+
+func (v *vocabulary) Decode(body []byte) (*Message, error) {
+	var envelope GQLOverWebsocketProtocol
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	message := &Message{
+		Type: v.clientTypes[envelope.Type],
+		ID:   envelope.ID,
+	}
+	if envelope.Payload != nil {
+		message.Payload = envelope.Payload.Bytes
+	}
+	return message, nil
+}
+
+func (v *vocabulary) Encode(message *Message) ([]byte, error) {
+	messageType, ok := v.serverTypes[message.Type]
+	if !ok {
+		return nil, fmt.Errorf("%v has no equivalent of %q", v.name, message.Type)
+	}
+	envelope := &GQLOverWebsocketProtocol{
+		Type: messageType,
+		ID:   message.ID,
+	}
+	if message.Errors != nil {
+		envelope.Payload = &PayloadBytes{Value: v.errorPayload(message.Errors)}
+	} else if message.Payload != nil {
+		envelope.Payload = &PayloadBytes{Value: message.Payload}
+	}
+	return json.Marshal(envelope)
+}
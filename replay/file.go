@@ -0,0 +1,171 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultSegmentSize is the size in bytes at which FileStore starts a new segment
+const DefaultSegmentSize = 8 * 1024 * 1024
+
+const segmentExtension = ".log"
+
+type fileRecord struct {
+	ClientID   string    `json:"clientId"`
+	ReceivedAt time.Time `json:"receivedAt"`
+	Frame      Frame     `json:"frame"`
+}
+
+type segment struct {
+	path   string
+	newest time.Time
+}
+
+// FileStore keeps frames in memory like MemoryStore, but also writes them to an append-only log of segment files
+// in a local directory. When a FileStore is opened on an existing directory, the frames still inside the retention window
+// are loaded back, so a restarted server can replay frames sent by the previous process.
+// Segments are deleted by Trim once every frame in them has expired.
+type FileStore struct {
+	SegmentSize int64
+	dir         string
+	memory      *MemoryStore
+	segments    []segment
+	current     *os.File
+	currentSize int64
+	mux         sync.Mutex
+}
+
+// OpenFileStore opens or creates a FileStore in dir, keeping at most size frames per client, for at most the retention duration
+func OpenFileStore(dir string, size int, retention time.Duration) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f := &FileStore{
+		SegmentSize: DefaultSegmentSize,
+		dir:         dir,
+		memory:      NewMemoryStore(size, retention),
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths) // segment names are zero padded timestamps, so this sorts them by age
+	for _, path := range paths {
+		newest, err := f.loadSegment(path)
+		if err != nil {
+			return nil, err
+		}
+		f.segments = append(f.segments, segment{path: path, newest: newest})
+	}
+	f.memory.Trim(time.Now())
+	if err := f.rotate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileStore) loadSegment(path string) (time.Time, error) {
+	var newest time.Time
+	file, err := os.Open(path)
+	if err != nil {
+		return newest, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Most likely a partially written record from a crash, the rest of the segment is still usable
+			fmt.Printf("Skipping malformed record in %s\n", path)
+			continue
+		}
+		f.memory.appendAt(record.ClientID, record.Frame, record.ReceivedAt)
+		newest = record.ReceivedAt
+	}
+	return newest, scanner.Err()
+}
+
+// rotate closes the current segment and starts a new one. The caller must hold the lock, if the store is in use
+func (f *FileStore) rotate() error {
+	if f.current != nil {
+		if err := f.current.Close(); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(f.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), segmentExtension))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	f.current = file
+	f.currentSize = 0
+	f.segments = append(f.segments, segment{path: path})
+	return nil
+}
+
+// Append writes the frame to the current segment and adds it to the in-memory index
+func (f *FileStore) Append(clientID string, frame Frame) error {
+	receivedAt := time.Now()
+	line, err := json.Marshal(fileRecord{ClientID: clientID, ReceivedAt: receivedAt, Frame: frame})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.currentSize >= f.SegmentSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.current.Write(line)
+	f.currentSize += int64(n)
+	if err != nil {
+		return err
+	}
+	f.segments[len(f.segments)-1].newest = receivedAt
+	f.memory.appendAt(clientID, frame, receivedAt)
+	return nil
+}
+
+// ReadAfter returns all frames for the client newer than lastEventID, see MemoryStore.ReadAfter
+func (f *FileStore) ReadAfter(clientID string, lastEventID string) ([]Frame, bool, error) {
+	return f.memory.ReadAfter(clientID, lastEventID)
+}
+
+// Trim removes frames older than the retention window, deleting segments that only contain expired frames
+func (f *FileStore) Trim(now time.Time) error {
+	f.memory.Trim(now)
+	cutoff := now.Add(-f.memory.retention)
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	remaining := f.segments[:0]
+	for i, val := range f.segments {
+		isCurrent := i == len(f.segments)-1
+		if !isCurrent && val.newest.Before(cutoff) {
+			if err := os.Remove(val.path); err != nil && !os.IsNotExist(err) {
+				fmt.Println(err)
+				fmt.Println("Couldn't remove expired replay segment")
+				remaining = append(remaining, val)
+			}
+			continue
+		}
+		remaining = append(remaining, val)
+	}
+	f.segments = remaining
+	return nil
+}
+
+// Close closes the current segment file
+func (f *FileStore) Close() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.current.Close()
+}
@@ -0,0 +1,100 @@
+package replay
+
+import (
+	"sync"
+	"time"
+)
+
+type bufferedFrame struct {
+	Frame
+	id         uint64
+	receivedAt time.Time
+}
+
+type clientBuffer struct {
+	frames []bufferedFrame
+	// evictedThrough is the highest event id that has been dropped from this buffer
+	evictedThrough uint64
+}
+
+// MemoryStore keeps a bounded number of recent frames per client in memory.
+// Frames are lost when the process restarts, see FileStore if that matters.
+type MemoryStore struct {
+	size      int
+	retention time.Duration
+	clients   map[string]*clientBuffer
+	mux       sync.Mutex
+}
+
+// NewMemoryStore creates a MemoryStore keeping at most size frames per client, for at most the retention duration
+func NewMemoryStore(size int, retention time.Duration) *MemoryStore {
+	return &MemoryStore{
+		size:      size,
+		retention: retention,
+		clients:   map[string]*clientBuffer{},
+	}
+}
+
+// Append adds a frame to the client's buffer, evicting the oldest frame if the buffer is full
+func (m *MemoryStore) Append(clientID string, frame Frame) error {
+	m.appendAt(clientID, frame, time.Now())
+	return nil
+}
+
+func (m *MemoryStore) appendAt(clientID string, frame Frame, receivedAt time.Time) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	buffer, ok := m.clients[clientID]
+	if !ok {
+		buffer = &clientBuffer{}
+		m.clients[clientID] = buffer
+	}
+	buffer.frames = append(buffer.frames, bufferedFrame{Frame: frame, id: ParseEventID(frame.ID), receivedAt: receivedAt})
+	if overflow := len(buffer.frames) - m.size; overflow > 0 {
+		buffer.evictedThrough = buffer.frames[overflow-1].id
+		buffer.frames = append([]bufferedFrame{}, buffer.frames[overflow:]...)
+	}
+}
+
+// ReadAfter returns all buffered frames for the client newer than lastEventID.
+// missed is true when frames after lastEventID may have been evicted, so the replay is incomplete.
+func (m *MemoryStore) ReadAfter(clientID string, lastEventID string) ([]Frame, bool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	lastSeen := ParseEventID(lastEventID)
+	buffer, ok := m.clients[clientID]
+	if !ok {
+		// Buffers are removed once everything in them has expired, so we can only be sure nothing
+		// was lost if the last seen event is still inside the retention window.
+		return nil, lastSeen < EventIDAt(time.Now().Add(-m.retention)), nil
+	}
+	var frames []Frame
+	for _, val := range buffer.frames {
+		if val.id > lastSeen {
+			frames = append(frames, val.Frame)
+		}
+	}
+	return frames, lastSeen < buffer.evictedThrough, nil
+}
+
+// Trim removes frames older than the retention window
+func (m *MemoryStore) Trim(now time.Time) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	cutoff := now.Add(-m.retention)
+	for clientID, buffer := range m.clients {
+		expired := 0
+		for expired < len(buffer.frames) && buffer.frames[expired].receivedAt.Before(cutoff) {
+			expired++
+		}
+		if expired == len(buffer.frames) {
+			delete(m.clients, clientID)
+			continue
+		}
+		if expired > 0 {
+			buffer.evictedThrough = buffer.frames[expired-1].id
+			buffer.frames = append([]bufferedFrame{}, buffer.frames[expired:]...)
+		}
+	}
+	return nil
+}
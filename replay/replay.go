@@ -0,0 +1,56 @@
+// Package replay contains the stores used to replay frames to clients that reconnect with a Last-Event-ID header.
+// Event ids are decimal strings derived from the clock, so ids issued after a server restart are
+// still greater than the ones issued before it, and can be compared across restarts.
+package replay
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/NickBlow/gqlssehandlers/protocol"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// Frame is a single message sent down a client's stream.
+// Frames carrying subscription results have an ID, which clients can send back in the Last-Event-ID header on reconnect.
+// Errors are sent in the payload of MessageError frames, in the shape the stream's protocol expects.
+// Retry, if set, is sent as the SSE retry hint, telling the client how long to wait before reconnecting
+type Frame struct {
+	ID             string                     `json:"id,omitempty"`
+	Type           protocol.MessageType       `json:"type"`
+	SubscriptionID string                     `json:"subscriptionId,omitempty"`
+	Payload        json.RawMessage            `json:"payload,omitempty"`
+	Errors         []gqlerrors.FormattedError `json:"errors,omitempty"`
+	Retry          time.Duration              `json:"-"`
+}
+
+// Store keeps recently sent frames per client so they can be replayed on reconnect.
+// Append is called for every frame with an ID, whether or not the client is connected.
+// ReadAfter returns the frames after lastEventID, with missed set to true if some of them are no longer available.
+// Trim is called periodically and should remove frames that are older than the store's retention window.
+// Stores are called from several goroutines at once, so implementations must be safe for concurrent use.
+type Store interface {
+	Append(clientID string, frame Frame) error
+	ReadAfter(clientID string, lastEventID string) (frames []Frame, missed bool, err error)
+	Trim(now time.Time) error
+}
+
+// EventIDAt returns the smallest event id that could have been issued at the given time
+func EventIDAt(t time.Time) uint64 {
+	return uint64(t.UnixNano())
+}
+
+// ParseEventID parses an event id, returning 0 if it is malformed
+func ParseEventID(id string) uint64 {
+	parsed, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return parsed
+}
+
+// FormatEventID formats an event id for use in a Frame
+func FormatEventID(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
@@ -1,5 +1,12 @@
 package subscriptions
 
+import (
+	"context"
+	"errors"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
 // Data encompasses a particular subscription and the client who requested it
 type Data struct {
 	SubscriptionID string
@@ -10,10 +17,18 @@ type Data struct {
 // It will use the schema passed into the handler config.
 // RequestString is the raw GraphQL request string
 // VariableValues are the values of the variables in the query
+// OperationName is the subscription to run if the request string contains several operations, it may be empty otherwise
 // This must be capable of being stored in and retreived from a database
 type Query struct {
 	RequestString  string
 	VariableValues map[string]interface{}
+	OperationName  string
+}
+
+// Request is a subscription a client has asked to start, along with its query
+type Request struct {
+	Data  Data
+	Query Query
 }
 
 // WrappedEvent contains the information needed to be sent to clients
@@ -25,3 +40,72 @@ type WrappedEvent struct {
 	QueryResult    interface{}
 	Finished       bool
 }
+
+// RawEvent is a domain event an adapter publishes once, rather than as a result for each subscription.
+// Topic says what the event is about, so filters can match it cheaply, and Payload is the event itself
+type RawEvent struct {
+	Topic   string
+	Payload interface{}
+}
+
+type contextKeyType string
+
+const parsedQueryKey contextKeyType = "parsed_query"
+
+const rawEventKey contextKeyType = "raw_event"
+
+const listenerKey contextKeyType = "listener"
+
+// Listener feeds the Subscribe resolvers of subscriptions executed by the library with the payloads of the raw events
+// published to their topics. The channel is never closed, the subscription ends when ctx is done
+type Listener interface {
+	Listen(ctx context.Context, topics ...string) chan interface{}
+}
+
+// ErrNotExecuted is returned by Listen when the subscription isn't executed by the library
+var ErrNotExecuted = errors.New("Subscription is not executed by the library, set HandlerConfig.ExecuteSubscriptions")
+
+// ParsedQuery is the parsed form of a Query. Document is the whole request string, and Operation the subscription
+// chosen by the OperationName
+type ParsedQuery struct {
+	Document  *ast.Document
+	Operation *ast.OperationDefinition
+}
+
+// WithParsedQuery returns a copy of the context carrying the parsed query
+func WithParsedQuery(ctx context.Context, parsed *ParsedQuery) context.Context {
+	return context.WithValue(ctx, parsedQueryKey, parsed)
+}
+
+// ParsedQueryFromContext returns the parsed query of the subscription being authorized, or nil if there isn't one
+func ParsedQueryFromContext(ctx context.Context) *ParsedQuery {
+	parsed, _ := ctx.Value(parsedQueryKey).(*ParsedQuery)
+	return parsed
+}
+
+// WithRawEvent returns a copy of the context carrying the raw event a query is executed for
+func WithRawEvent(ctx context.Context, event RawEvent) context.Context {
+	return context.WithValue(ctx, rawEventKey, event)
+}
+
+// RawEventFromContext returns the raw event a query is being executed for, so resolvers can read it,
+// and false if the query wasn't executed for one
+func RawEventFromContext(ctx context.Context) (RawEvent, bool) {
+	event, ok := ctx.Value(rawEventKey).(RawEvent)
+	return event, ok
+}
+
+// WithListener returns a copy of the context carrying the listener for its subscription's topics
+func WithListener(ctx context.Context, listener Listener) context.Context {
+	return context.WithValue(ctx, listenerKey, listener)
+}
+
+// Listen returns a channel of the payloads of the raw events published to any of the topics, for the Subscribe
+// resolver of a graphql-go field to return. Each payload is the root value the subscription's query is executed with
+func Listen(ctx context.Context, topics ...string) (chan interface{}, error) {
+	listener, ok := ctx.Value(listenerKey).(Listener)
+	if !ok {
+		return nil, ErrNotExecuted
+	}
+	return listener.Listen(ctx, topics...), nil
+}